@@ -1,20 +1,35 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/urfave/cli"
 
 	"github.com/sensiblecodeio/hookbot/pkg/hookbot"
+	"github.com/sensiblecodeio/hookbot/pkg/listen"
+	_ "github.com/sensiblecodeio/hookbot/pkg/router/bitbucket"
+	_ "github.com/sensiblecodeio/hookbot/pkg/router/gitea"
 	"github.com/sensiblecodeio/hookbot/pkg/router/github"
+	_ "github.com/sensiblecodeio/hookbot/pkg/router/gitlab"
+	_ "github.com/sensiblecodeio/hookbot/pkg/router/rules"
 )
 
 func main() {
+	NewApp().RunAndExitOnError()
+}
+
+func NewApp() *cli.App {
 	app := cli.NewApp()
 	app.Name = "hookbot"
 	app.Usage = "turn webhooks into websockets"
@@ -27,6 +42,12 @@ func main() {
 			Value:  "<unset>",
 			EnvVar: "HOOKBOT_KEY",
 		},
+		cli.StringSliceFlag{
+			Name:   "old-key",
+			Usage:  "previous keys whose tokens are still accepted, newest first",
+			Value:  &cli.StringSlice{},
+			EnvVar: "HOOKBOT_OLD_KEYS",
+		},
 		cli.StringFlag{
 			Name:   "github-secret",
 			Usage:  "secret known by github for signing messages",
@@ -61,6 +82,138 @@ func main() {
 					Value: &cli.StringSlice{},
 					Usage: "list of routers to enable",
 				},
+				cli.BoolFlag{
+					Name:  "github-require-sha256",
+					Usage: "make the github router reject webhooks without an X-Hub-Signature-256",
+				},
+				cli.StringFlag{
+					Name:  "gitlab-host",
+					Value: "gitlab.com",
+					Usage: "host whose webhooks the gitlab router consumes from /unsafe/<host>/",
+				},
+				cli.StringFlag{
+					Name:   "gitlab-secret",
+					Usage:  "secret token configured for GitLab webhooks, required for ?extra-metadata=gitlab",
+					EnvVar: "HOOKBOT_GITLAB_SECRET",
+				},
+				cli.StringFlag{
+					Name:  "gitea-host",
+					Value: "gitea.com",
+					Usage: "host whose webhooks the gitea router consumes from /unsafe/<host>/",
+				},
+				cli.StringFlag{
+					Name:   "gitea-secret",
+					Usage:  "secret for Gitea or Forgejo webhook signatures, required by the gitea router",
+					EnvVar: "HOOKBOT_GITEA_SECRET",
+				},
+				cli.StringFlag{
+					Name:   "bitbucket-secret",
+					Usage:  "secret for Bitbucket webhook signatures, required by the bitbucket router",
+					EnvVar: "HOOKBOT_BITBUCKET_SECRET",
+				},
+				cli.StringFlag{
+					Name:  "rules-file",
+					Usage: "JSON file of rules for the rules router",
+				},
+				cli.StringSliceFlag{
+					Name:  "push",
+					Value: &cli.StringSlice{},
+					Usage: "topic=url: POST messages published on topic to url",
+				},
+				cli.StringFlag{
+					Name:   "push-secret",
+					Usage:  "secret for signing messages sent to --push URLs",
+					EnvVar: "HOOKBOT_PUSH_SECRET",
+				},
+				cli.BoolFlag{
+					Name:  "reject-sha1-tokens",
+					Usage: "only accept HMAC-SHA256 tokens",
+				},
+				cli.BoolFlag{
+					Name:  "require-expiring-tokens",
+					Usage: "only accept tokens made with make-tokens --expires",
+				},
+				cli.StringFlag{
+					Name:  "revoked-tokens",
+					Usage: "file of SHA-256 hashes of tokens to reject, reloaded on SIGHUP",
+				},
+				cli.StringFlag{
+					Name:   "jwt-secret",
+					Usage:  "accept bearer JWTs signed with this HS256 secret",
+					EnvVar: "HOOKBOT_JWT_SECRET",
+				},
+				cli.StringFlag{
+					Name:  "jwt-public-key",
+					Usage: "accept bearer JWTs signed with the RS256 or ES256 key in this PEM file",
+				},
+				cli.StringSliceFlag{
+					Name:  "unsafe-allow",
+					Value: &cli.StringSlice{},
+					Usage: "prefix=file: only accept /unsafe/pub/ under prefix from the CIDRs in file",
+				},
+				cli.StringSliceFlag{
+					Name:  "trusted-proxy",
+					Value: &cli.StringSlice{},
+					Usage: "CIDR of a proxy trusted to set X-Forwarded-For",
+				},
+				cli.StringSliceFlag{
+					Name:  "rate-limit",
+					Value: &cli.StringSlice{},
+					Usage: "prefix=rate[:burst]: limit publishes per second to topics under prefix",
+				},
+				cli.StringFlag{
+					Name:  "client-rate-limit",
+					Usage: "rate[:burst]: limit publishes per second by each token or address",
+				},
+				cli.Int64Flag{
+					Name:  "max-body-size",
+					Usage: "reject published messages larger than this many bytes (e.g. 1048576, default no limit)",
+				},
+				cli.StringSliceFlag{
+					Name:  "max-body-size-for",
+					Value: &cli.StringSlice{},
+					Usage: "prefix=bytes: a different --max-body-size for topics under prefix",
+				},
+				cli.StringSliceFlag{
+					Name:  "metadata-header",
+					Value: &cli.StringSlice{},
+					Usage: "only pass on these headers with ?extra-metadata=headers (default all but Authorization and Cookie)",
+				},
+				cli.StringFlag{
+					Name:  "client-ca",
+					Usage: "accept TLS client certificates issued by the CAs in this PEM file (requires --sslkey)",
+				},
+				cli.StringFlag{
+					Name:  "client-identities",
+					Usage: "JSON file mapping client certificate identities to the topics they may use",
+				},
+				cli.StringFlag{
+					Name:   "metrics-token",
+					Usage:  "token required to read /metrics (unprotected if unset)",
+					EnvVar: "HOOKBOT_METRICS_TOKEN",
+				},
+				cli.IntFlag{
+					Name:  "history",
+					Value: 0,
+					Usage: "number of messages to keep per topic for replay with ?since= (0 disables)",
+				},
+				cli.StringFlag{
+					Name:  "data-dir",
+					Usage: "directory for a durable log of published messages (disabled if unset)",
+				},
+				cli.DurationFlag{
+					Name:  "retain-age",
+					Usage: "discard logged messages older than this (0 keeps them)",
+				},
+				cli.Int64Flag{
+					Name:  "retain-size",
+					Usage: "discard the oldest logged messages beyond this many bytes (0 keeps them)",
+				},
+				cli.Int64Flag{
+					Name:  "segment-size",
+					Value: hookbot.DefaultSegmentSize,
+					Usage: "size in bytes at which a new log segment is started",
+				},
 			},
 		},
 		{
@@ -73,6 +226,31 @@ func main() {
 					Name:  "bare",
 					Usage: "print only tokens (not as basic-auth URLs)",
 				},
+				cli.StringFlag{
+					Name:  "algorithm, a",
+					Value: hookbot.SHA1,
+					Usage: "HMAC algorithm for the tokens (sha1 or sha256)",
+				},
+				cli.DurationFlag{
+					Name:  "expires, e",
+					Usage: "make tokens which expire after this long (e.g. 24h)",
+				},
+				cli.BoolFlag{
+					Name:  "publish-only",
+					Usage: "make tokens which can only be used to publish",
+				},
+				cli.BoolFlag{
+					Name:  "subscribe-only",
+					Usage: "make tokens which can only be used to subscribe",
+				},
+				cli.BoolFlag{
+					Name:  "exact",
+					Usage: "make tokens which are not valid for paths below the given one",
+				},
+				cli.Int64Flag{
+					Name:  "max-size",
+					Usage: "make tokens which can only publish messages up to this many bytes",
+				},
 				cli.StringFlag{
 					Name:   "url-base, U",
 					Value:  "http://localhost:8080",
@@ -102,11 +280,20 @@ func main() {
 					Value:  &cli.StringSlice{},
 					EnvVar: "HOOKBOT_HEADER",
 				},
+				cli.BoolFlag{
+					Name:  "require-sha256",
+					Usage: "reject messages without an X-Hub-Signature-256 signature",
+				},
+				cli.Int64Flag{
+					Name:  "max-message-size",
+					Value: listen.DefaultMaxMessageSize,
+					Usage: "largest message to accept from the server, in bytes",
+				},
 			},
 		},
 	}
 
-	app.RunAndExitOnError()
+	return app
 }
 
 var SubscribeURIRE = regexp.MustCompile("^(?:/unsafe)?/sub")
@@ -146,13 +333,32 @@ func ActionMakeTokens(c *cli.Context) {
 		return scheme + secure
 	}
 
+	claims := hookbot.Claims{
+		Publish:   c.Bool("publish-only"),
+		Subscribe: c.Bool("subscribe-only"),
+		Exact:     c.Bool("exact"),
+		MaxSize:   c.Int64("max-size"),
+	}
+	if claims.Publish && claims.Subscribe {
+		log.Fatalln("--publish-only and --subscribe-only are mutually exclusive")
+	}
+	if expires := c.Duration("expires"); expires != 0 {
+		claims.Expires = time.Now().Add(expires)
+	}
+
 	for _, arg := range c.Args() {
 		argURL, err := url.Parse(arg)
 		if err != nil {
 			log.Fatalf("URL %q doesn't parse: %v", arg, err)
 		}
+		if claims.Exact && strings.HasSuffix(argURL.Path, "/") {
+			log.Fatalf("--exact tokens can't be made for recursive path %q", argURL.Path)
+		}
 
-		mac := hookbot.Sha1HMAC(key, argURL.Path)
+		mac, err := hookbot.MakeToken(c.String("algorithm"), key, argURL.Path, claims)
+		if err != nil {
+			log.Fatal(err)
+		}
 		if c.Bool("bare") {
 			fmt.Println(mac)
 		} else {
@@ -186,28 +392,189 @@ func ActionServe(c *cli.Context) {
 		log.Fatalln("HOOKBOT_KEY not set")
 	}
 
-	hb := hookbot.New(key)
+	config, tlsConfig := ServeConfig(c)
+	hb := hookbot.NewWithConfig(key, config)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			err := hb.ReloadRevocations()
+			if err != nil {
+				log.Printf("Error reloading revocation list: %v", err)
+			}
+		}
+	}()
 
 	// Setup routers configured on the command line
 	hookbot.ConfigureRouters(c, hb)
 
+	for _, push := range c.StringSlice("push") {
+		p, err := hookbot.ParsePushSubscription(push, c.String("push-secret"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Push %q to %v", p.Topic, p.URL)
+		hb.AddPush(p)
+	}
+
 	http.Handle("/", hb)
 	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(w, "OK")
 	})
+	http.Handle("/metrics", hb.MetricsHandler(c.String("metrics-token")))
+	http.Handle("/admin/reload-revocations",
+		hb.KeyChecker(http.HandlerFunc(hb.ServeReloadRevocations)))
 
 	log.Println("Listening on", c.String("bind"))
 
 	sslkey := c.String("sslkey")
 
 	var err error
-
 	if sslkey == "<unset>" {
 		err = http.ListenAndServe(c.String("bind"), nil)
 	} else {
-		err = http.ListenAndServeTLS(c.String("bind"), c.String("sslcrt"), c.String("sslkey"), nil)
+		server := &http.Server{Addr: c.String("bind"), TLSConfig: tlsConfig}
+		err = server.ListenAndServeTLS(c.String("sslcrt"), c.String("sslkey"))
 	}
 	if err != nil {
 		log.Fatal(err)
 	}
 }
+
+// ServeConfig builds the server's configuration from the serve command's
+// flags, and the global --old-key.
+func ServeConfig(c *cli.Context) (hookbot.Config, *tls.Config) {
+	var store *hookbot.Store
+	if dir := c.String("data-dir"); dir != "" {
+		var err error
+		store, err = hookbot.OpenStore(hookbot.StoreConfig{
+			Dir:         dir,
+			SegmentSize: c.Int64("segment-size"),
+			MaxAge:      c.Duration("retain-age"),
+			MaxSize:     c.Int64("retain-size"),
+		})
+		if err != nil {
+			log.Fatalf("Unable to open data dir %q: %v", dir, err)
+		}
+	}
+
+	var revocations *hookbot.RevocationList
+	if path := c.String("revoked-tokens"); path != "" {
+		var err error
+		revocations, err = hookbot.LoadRevocationList(path)
+		if err != nil {
+			log.Fatalf("Unable to load revoked tokens: %v", err)
+		}
+	}
+
+	var jwt *hookbot.JWTVerifier
+	if c.String("jwt-secret") != "" || c.String("jwt-public-key") != "" {
+		var err error
+		jwt, err = hookbot.NewJWTVerifier(
+			c.String("jwt-secret"), c.String("jwt-public-key"))
+		if err != nil {
+			log.Fatalf("Unable to configure JWT authentication: %v", err)
+		}
+	}
+
+	tlsConfig := &tls.Config{}
+	var clientIdentities []hookbot.ClientIdentity
+	if path := c.String("client-ca"); path != "" {
+		if c.String("sslkey") == "<unset>" {
+			log.Fatal("--client-ca requires --sslkey and --sslcrt")
+		}
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Unable to read client CA bundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("No certificates found in client CA bundle %q", path)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+
+		clientIdentities, err = hookbot.LoadClientIdentities(
+			c.String("client-identities"))
+		if err != nil {
+			log.Fatalf("Unable to load client identities: %v", err)
+		}
+	}
+
+	var allowlists []hookbot.Allowlist
+	for _, allow := range c.StringSlice("unsafe-allow") {
+		prefix, path, ok := strings.Cut(allow, "=")
+		if !ok {
+			log.Fatalf("--unsafe-allow %q is not of the form prefix=file", allow)
+		}
+		a, err := hookbot.LoadAllowlist(prefix, path)
+		if err != nil {
+			log.Fatalf("Unable to load allowlist: %v", err)
+		}
+		warnExactPrefix("--unsafe-allow", a.Prefix)
+		allowlists = append(allowlists, a)
+	}
+
+	trustedProxies, err := hookbot.ParseCIDRs(c.StringSlice("trusted-proxy"))
+	if err != nil {
+		log.Fatalf("Invalid --trusted-proxy: %v", err)
+	}
+
+	var topicRateLimits []hookbot.TopicRateLimit
+	for _, limit := range c.StringSlice("rate-limit") {
+		l, err := hookbot.ParseTopicRateLimit(limit)
+		if err != nil {
+			log.Fatal(err)
+		}
+		warnExactPrefix("--rate-limit", l.Prefix)
+		topicRateLimits = append(topicRateLimits, l)
+	}
+
+	var clientRateLimit hookbot.RateLimit
+	if limit := c.String("client-rate-limit"); limit != "" {
+		clientRateLimit, err = hookbot.ParseRateLimit(limit)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var bodySizeLimits []hookbot.BodySizeLimit
+	for _, limit := range c.StringSlice("max-body-size-for") {
+		l, err := hookbot.ParseBodySizeLimit(limit)
+		if err != nil {
+			log.Fatal(err)
+		}
+		warnExactPrefix("--max-body-size-for", l.Prefix)
+		bodySizeLimits = append(bodySizeLimits, l)
+	}
+
+	config := hookbot.Config{
+		OldKeys:          c.GlobalStringSlice("old-key"),
+		HistorySize:      c.Int("history"),
+		Store:            store,
+		RejectSHA1:       c.Bool("reject-sha1-tokens"),
+		RequireExpiry:    c.Bool("require-expiring-tokens"),
+		Revocations:      revocations,
+		JWT:              jwt,
+		ClientIdentities: clientIdentities,
+		UnsafeAllowlists: allowlists,
+		TrustedProxies:   trustedProxies,
+		TopicRateLimits:  topicRateLimits,
+		ClientRateLimit:  clientRateLimit,
+		MaxBodySize:      c.Int64("max-body-size"),
+		BodySizeLimits:   bodySizeLimits,
+		MetadataHeaders:  c.StringSlice("metadata-header"),
+		GitlabSecret:     c.String("gitlab-secret"),
+	}
+	return config, tlsConfig
+}
+
+// Prefixes without a trailing "/" cover only the topic of that name, which is
+// easily done by mistake.
+func warnExactPrefix(flag, prefix string) {
+	if !strings.HasSuffix(prefix, "/") {
+		log.Printf("Warning: %s prefix %q doesn't end in \"/\", so it "+
+			"only applies to that exact topic", flag, prefix)
+	}
+}
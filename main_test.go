@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/urfave/cli"
+
+	"github.com/sensiblecodeio/hookbot/pkg/hookbot"
+)
+
+// Parse `args` with the real flags, returning the serve command's config.
+func serveConfig(t *testing.T, args ...string) hookbot.Config {
+	app := NewApp()
+
+	var config hookbot.Config
+	for i := range app.Commands {
+		if app.Commands[i].Name == "serve" {
+			app.Commands[i].Action = func(c *cli.Context) {
+				config, _ = ServeConfig(c)
+			}
+		}
+	}
+
+	err := app.Run(append([]string{"hookbot"}, args...))
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	return config
+}
+
+func TestServeOldKeys(t *testing.T) {
+	config := serveConfig(t, "--key", "new", "--old-key", "a", "--old-key", "b", "serve")
+	if !reflect.DeepEqual(config.OldKeys, []string{"a", "b"}) {
+		t.Errorf("OldKeys = %v, expected [a b]", config.OldKeys)
+	}
+}
+
+func TestServeOldKeysFromEnvironment(t *testing.T) {
+	t.Setenv("HOOKBOT_OLD_KEYS", "a,b")
+
+	config := serveConfig(t, "--key", "new", "serve")
+	if !reflect.DeepEqual(config.OldKeys, []string{"a", "b"}) {
+		t.Errorf("OldKeys = %v, expected [a b]", config.OldKeys)
+	}
+}
+
+func TestServeMaxBodySize(t *testing.T) {
+	config := serveConfig(t, "--key", "k", "serve")
+	if config.MaxBodySize != 0 {
+		t.Errorf("Default MaxBodySize = %d, expected no limit", config.MaxBodySize)
+	}
+
+	config = serveConfig(t, "--key", "k", "serve", "--max-body-size", "1048576")
+	if config.MaxBodySize != 1<<20 {
+		t.Errorf("MaxBodySize = %d, expected 1 MiB", config.MaxBodySize)
+	}
+}
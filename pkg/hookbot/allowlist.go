@@ -0,0 +1,155 @@
+package hookbot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// An Allowlist restricts unauthenticated publishing to topics under Prefix
+// (without the /unsafe/pub/) to clients with addresses in Nets. Without a
+// trailing "/", Prefix protects only the topic of that name.
+type Allowlist struct {
+	Prefix string
+	Nets   []*net.IPNet
+}
+
+// LoadAllowlist reads the allowed networks for `prefix` from `path`. The file
+// is either a list of CIDRs or addresses, one per line, with "#" starting a
+// comment, or JSON from GitHub's meta API (https://api.github.com/meta), in
+// which case its "hooks" ranges are used.
+func LoadAllowlist(prefix, path string) (Allowlist, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Allowlist{}, err
+	}
+
+	var entries []string
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var meta struct {
+			Hooks []string `json:"hooks"`
+		}
+		err = json.Unmarshal(data, &meta)
+		if err != nil {
+			return Allowlist{}, err
+		}
+		entries = meta.Hooks
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line, _, _ := strings.Cut(scanner.Text(), "#")
+			if line = strings.TrimSpace(line); line != "" {
+				entries = append(entries, line)
+			}
+		}
+	}
+
+	nets, err := ParseCIDRs(entries)
+	if err != nil {
+		return Allowlist{}, fmt.Errorf("%v: %v", path, err)
+	}
+	return Allowlist{Prefix: prefix, Nets: nets}, nil
+}
+
+// ParseCIDRs parses networks in CIDR notation. Plain addresses are taken to
+// be networks of one address.
+func ParseCIDRs(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 8 * net.IPv6len
+			}
+			entry = fmt.Sprintf("%v/%d", entry, bits)
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client making `r`. X-Forwarded-For is
+// only believed for hops made through one of `trustedProxies`.
+func ClientIP(r *http.Request, trustedProxies []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+
+	// Walk back along the chain of proxies until reaching an address which
+	// isn't trusted to report the one before it.
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		if ip == nil || !containsIP(trustedProxies, ip) {
+			break
+		}
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+	}
+	return ip
+}
+
+// The allowlist which applies to `topic`, the one with the longest matching
+// prefix, or nil if there isn't one.
+func (h *Hookbot) allowlistFor(topic string) *Allowlist {
+	var found *Allowlist
+	for i, a := range h.unsafeAllowlists {
+		if !TopicAllowed([]string{a.Prefix}, topic) {
+			continue
+		}
+		if found == nil || len(a.Prefix) > len(found.Prefix) {
+			found = &h.unsafeAllowlists[i]
+		}
+	}
+	return found
+}
+
+// UnsafeAllowlistChecker rejects unsafe publishes from clients outside the
+// allowlist for the topic. Topics without an allowlist are unrestricted.
+func (h *Hookbot) UnsafeAllowlistChecker(wrapped http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a := h.allowlistFor(strings.TrimPrefix(Topic(r), "/unsafe/"))
+		if a == nil {
+			wrapped.ServeHTTP(w, r)
+			return
+		}
+
+		ip := ClientIP(r, h.trustedProxies)
+		if ip == nil || !containsIP(a.Nets, ip) {
+			atomic.AddInt64(&h.rejectU, 1)
+			log.Printf("Rejected unsafe publish to %q from %v", r.URL.Path, ip)
+			http.Error(w, "403 Forbidden", http.StatusForbidden)
+			return
+		}
+
+		wrapped.ServeHTTP(w, r)
+	}
+}
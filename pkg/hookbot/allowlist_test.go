@@ -0,0 +1,82 @@
+package hookbot
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadAllowlistGithubMeta(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "meta.json")
+	meta := `{"hooks": ["192.30.252.0/22", "2a0a:a440::/29"], "web": ["1.2.3.4/32"]}`
+	if err := os.WriteFile(path, []byte(meta), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := LoadAllowlist("github/", path)
+	if err != nil {
+		t.Fatalf("LoadAllowlist: %v", err)
+	}
+	if len(a.Nets) != 2 || a.Nets[0].String() != "192.30.252.0/22" {
+		t.Errorf("Unexpected networks: %v", a.Nets)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseCIDRs([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		remote, forwarded, want string
+	}{
+		{"1.2.3.4:5678", "", "1.2.3.4"},
+		{"1.2.3.4:5678", "5.6.7.8", "1.2.3.4"}, // Not from a trusted proxy.
+		{"10.0.0.1:5678", "5.6.7.8", "5.6.7.8"},
+		{"10.0.0.1:5678", "9.9.9.9, 5.6.7.8, 10.0.0.2", "5.6.7.8"},
+	} {
+		_, r := MakeRequest("POST", "/unsafe/pub/foo", "")
+		r.RemoteAddr = tc.remote
+		if tc.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		if got := ClientIP(r, proxies); got.String() != tc.want {
+			t.Errorf("ClientIP(%v, %q) != %v (= %v)",
+				tc.remote, tc.forwarded, tc.want, got)
+		}
+	}
+}
+
+func TestUnsafeAllowlist(t *testing.T) {
+	nets, err := ParseCIDRs([]string{"192.30.252.0/22", "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hookbot := NewWithConfig(TEST_KEY, Config{
+		UnsafeAllowlists: []Allowlist{{Prefix: "github/", Nets: nets}},
+	})
+	defer hookbot.Shutdown()
+
+	publish := func(target, remote string) int {
+		w, r := MakeRequest("POST", target, "MESSAGE")
+		r.RemoteAddr = remote
+		hookbot.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := publish("/unsafe/pub/github/hook", "192.30.253.1:1234"); code != http.StatusOK {
+		t.Errorf("Allowed address: status code != 200 (= %v)", code)
+	}
+	if code := publish("/unsafe/pub/github/hook", "1.2.3.4:1234"); code != http.StatusForbidden {
+		t.Errorf("Disallowed address: status code != 403 (= %v)", code)
+	}
+	if code := publish("/unsafe/pub/other", "1.2.3.4:1234"); code != http.StatusOK {
+		t.Errorf("Unrestricted topic: status code != 200 (= %v)", code)
+	}
+	if hookbot.rejectU != 1 {
+		t.Errorf("Rejected count != 1 (= %v)", hookbot.rejectU)
+	}
+}
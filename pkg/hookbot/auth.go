@@ -3,11 +3,15 @@ package hookbot
 import (
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/subtle"
 	"fmt"
+	"log"
 	"net/http"
 	"regexp"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 func Sha1HMAC(key, payload string) string {
@@ -16,6 +20,44 @@ func Sha1HMAC(key, payload string) string {
 	return fmt.Sprintf("%x", mac.Sum(nil))
 }
 
+func Sha256HMAC(key, payload string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	_, _ = mac.Write([]byte(payload))
+	return fmt.Sprintf("%x", mac.Sum(nil))
+}
+
+// Token algorithms understood by HMAC.
+const (
+	SHA1   = "sha1"
+	SHA256 = "sha256"
+)
+
+// HMAC computes a token for payload using the named algorithm.
+func HMAC(algorithm, key, payload string) (string, error) {
+	switch algorithm {
+	case SHA1:
+		return Sha1HMAC(key, payload), nil
+	case SHA256:
+		return Sha256HMAC(key, payload), nil
+	}
+	return "", fmt.Errorf("unknown token algorithm %q", algorithm)
+}
+
+// Return the HMAC function which a token was made with, which is implied by
+// its length. Returns nil if the token can't be valid.
+func (h *Hookbot) hmacFor(token string) func(key, payload string) string {
+	switch len(token) {
+	case sha1.Size * 2:
+		if h.rejectSHA1 {
+			return nil
+		}
+		return Sha1HMAC
+	case sha256.Size * 2:
+		return Sha256HMAC
+	}
+	return nil
+}
+
 func SecureEqual(x, y string) bool {
 	if subtle.ConstantTimeCompare([]byte(x), []byte(y)) == 1 {
 		return true
@@ -39,48 +81,142 @@ func subpaths(s string) []string {
 }
 
 func (h *Hookbot) IsKeyOK(w http.ResponseWriter, r *http.Request) bool {
+	_, ok := h.checkKey(r)
+	return ok
+}
+
+// Return the token given in the Authorization header, either as the basic
+// auth username or as a bearer token.
+func givenToken(r *http.Request) (string, bool) {
 
 	authorization := r.Header.Get("Authorization")
 	fields := strings.Fields(authorization)
 
 	if len(fields) != 2 {
-		return false
+		return "", false
 	}
 
 	authType, givenKey := fields[0], fields[1]
 
-	var givenMac string
-
 	switch strings.ToLower(authType) {
 	default:
-		return false // Not understood
+		return "", false // Not understood
 	case "basic":
-		var ok bool
-		givenMac, _, ok = r.BasicAuth()
-		if !ok {
-			return false
-		}
+		givenToken, _, ok := r.BasicAuth()
+		return givenToken, ok
 
 	case "bearer":
-		givenMac = givenKey // No processing required
+		return givenKey, true // No processing required
+	}
+}
+
+// Returns true if the request's token was given as a bearer token.
+func isBearer(r *http.Request) bool {
+	fields := strings.Fields(r.Header.Get("Authorization"))
+	return len(fields) == 2 && strings.EqualFold(fields[0], "bearer")
+}
+
+// Check the request's token, returning the claims it carries if it is valid.
+func (h *Hookbot) checkKey(r *http.Request) (Claims, bool) {
+
+	if h.IsClientCertOK(r) {
+		return Claims{}, true
+	}
+
+	givenToken, ok := givenToken(r)
+	if !ok {
+		return Claims{}, false
+	}
+
+	if h.jwt != nil && LooksLikeJWT(givenToken) {
+		if !isBearer(r) {
+			return Claims{}, false // JWTs are only accepted as bearer tokens.
+		}
+		jwtClaims, err := h.jwt.Verify(givenToken, time.Now())
+		if err != nil {
+			log.Printf("Rejected JWT for %q: %v", r.URL.Path, err)
+			return Claims{}, false
+		}
+		if !jwtClaims.Allows(r) {
+			return Claims{}, false
+		}
+		return Claims{Expires: time.Unix(jwtClaims.Expires, 0)}, true
+	}
+
+	givenClaims, givenMac := splitToken(givenToken)
+
+	claims, err := ParseClaims(givenClaims)
+	if err != nil {
+		return Claims{}, false
+	}
+	if claims.Expires.IsZero() && h.requireExpiry {
+		return Claims{}, false
+	}
+	if !claims.Expires.IsZero() && time.Now().After(claims.Expires) {
+		return Claims{}, false
+	}
+	if !claims.Permits(r) {
+		return Claims{}, false
+	}
+
+	mac := h.hmacFor(givenMac)
+	if mac == nil {
+		return Claims{}, false
+	}
+
+	// Try each key, newest first.
+	for generation, key := range h.keys {
+		matched, exact := isMacForPath(
+			mac, key, r.URL.Path, givenClaims, givenMac)
+		if !matched || (claims.Exact && !exact) {
+			continue
+		}
+
+		atomic.AddInt64(&h.metrics.keyGenerations[generation], 1)
+		if generation > 0 {
+			log.Printf("Token for %q matched old key generation %d",
+				r.URL.Path, generation)
+		}
+		return claims, true
 	}
 
+	return Claims{}, false
+}
+
+// Returns true if givenMac is valid for `path` under `key`. exact is true if
+// it is valid for `path` itself rather than a prefix of it, and `path` is not
+// a recursive subscription.
+func isMacForPath(
+	mac func(key, payload string) string,
+	key, path, givenClaims, givenMac string,
+) (matched, exact bool) {
+	path = macPath(path)
+	_, isRecursive := recursive(path)
+
 	// Try all subpaths and see if any of them matches the given MAC.
-	for _, subpath := range subpaths(r.URL.Path) {
-		expectedMac := Sha1HMAC(h.key, subpath)
+	for _, subpath := range subpaths(path) {
+		expectedMac := mac(key, tokenPayload(subpath, givenClaims))
 		if SecureEqual(givenMac, expectedMac) {
-			return true
+			return true, subpath == path && !isRecursive
 		}
 
 		// See if HMAC matches the URL without the {/pub,/sub} prefix.
 		// These tokens are valid for both pub and sub.
-		expectedMac = Sha1HMAC(h.key, noPrefix(subpath))
+		expectedMac = mac(key, tokenPayload(noPrefix(subpath), givenClaims))
 		if SecureEqual(givenMac, expectedMac) {
-			return true
+			return true, subpath == path && !isRecursive
 		}
 	}
+	return false, false
+}
 
-	return false
+// Long-polling is a form of subscription, so /poll/ URLs accept the same
+// tokens as the equivalent /sub/ URL.
+func macPath(path string) string {
+	if strings.HasPrefix(path, "/poll/") {
+		return "/sub/" + strings.TrimPrefix(path, "/poll/")
+	}
+	return path
 }
 
 func noPrefix(withPrefix string) string {
@@ -136,12 +272,24 @@ func (h *Hookbot) KeyChecker(wrapped http.Handler) http.HandlerFunc {
 			return
 		}
 
-		if !h.IsKeyOK(w, r) {
+		if token, ok := givenToken(r); ok && h.revocations.IsRevoked(token) {
+			w.Header().Add("WWW-Authenticate", `Basic realm="hookbot"`)
+			http.Error(w, "401 Unauthorized (token revoked)",
+				http.StatusUnauthorized)
+			return
+		}
+
+		claims, ok := h.checkKey(r)
+		if !ok {
 			w.Header().Add("WWW-Authenticate", `Basic realm="hookbot"`)
 			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
+		r = WithClaims(r, claims)
+		if token, ok := givenToken(r); ok && !h.IsClientCertOK(r) {
+			r = withVerifiedToken(r, token)
+		}
 		wrapped.ServeHTTP(w, r)
 	}
 }
@@ -3,11 +3,17 @@ package hookbot
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 const (
@@ -258,3 +264,251 @@ func TestUnsafeSubWithHeader(t *testing.T) {
 		t.Errorf("Response body incorrect, got: %q", response)
 	}
 }
+
+// HMAC-SHA256 tokens are accepted alongside SHA-1, unless SHA-1 is rejected.
+func TestAuthSha256(t *testing.T) {
+	for _, test := range []struct {
+		token      string
+		rejectSHA1 bool
+		expected   int
+	}{
+		{Sha256HMAC(TEST_KEY, "/pub/place"), false, http.StatusOK},
+		{Sha256HMAC(TEST_KEY, "/pub/place"), true, http.StatusOK},
+		{Sha1HMAC(TEST_KEY, "/pub/place"), true, http.StatusUnauthorized},
+		{Sha256HMAC(TEST_KEY, "/pub/elsewhere"), false, http.StatusUnauthorized},
+	} {
+		w, r := MakeRequest("POST", "/pub/place", "MESSAGE")
+		r.SetBasicAuth(test.token, "")
+
+		func() {
+			hookbot := NewWithConfig(TEST_KEY, Config{RejectSHA1: test.rejectSHA1})
+			defer hookbot.Shutdown()
+
+			hookbot.ServeHTTP(w, r)
+		}()
+
+		if w.Code != test.expected {
+			t.Errorf("Status code != %v (= %v) for %+v",
+				test.expected, w.Code, test)
+		}
+	}
+}
+
+// Tokens carrying an expiry are accepted until they expire, and can't be
+// altered to extend their life.
+func TestAuthExpiringToken(t *testing.T) {
+	future := Claims{Expires: time.Now().Add(time.Hour)}
+	past := Claims{Expires: time.Now().Add(-time.Hour)}
+
+	valid, _ := MakeToken(SHA256, TEST_KEY, "/pub/place", future)
+	expired, _ := MakeToken(SHA256, TEST_KEY, "/pub/place", past)
+	_, mac := splitToken(expired)
+	forged := future.String() + "." + mac
+	plain := Sha1HMAC(TEST_KEY, "/pub/place")
+
+	for _, test := range []struct {
+		token         string
+		requireExpiry bool
+		expected      int
+	}{
+		{valid, false, http.StatusOK},
+		{valid, true, http.StatusOK},
+		{expired, false, http.StatusUnauthorized},
+		{forged, false, http.StatusUnauthorized},
+		{plain, false, http.StatusOK},
+		{plain, true, http.StatusUnauthorized},
+	} {
+		w, r := MakeRequest("POST", "/pub/place", "MESSAGE")
+		r.SetBasicAuth(test.token, "")
+
+		func() {
+			hookbot := NewWithConfig(TEST_KEY, Config{RequireExpiry: test.requireExpiry})
+			defer hookbot.Shutdown()
+
+			hookbot.ServeHTTP(w, r)
+		}()
+
+		if w.Code != test.expected {
+			t.Errorf("Status code != %v (= %v) for %+v",
+				test.expected, w.Code, test)
+		}
+	}
+}
+
+// Tokens made with an old key are accepted, but not those made with a key
+// which has been dropped.
+func TestAuthOldKeys(t *testing.T) {
+	config := Config{OldKeys: []string{"old", "older"}}
+
+	for _, test := range []struct {
+		key      string
+		expected int
+	}{
+		{TEST_KEY, http.StatusOK},
+		{"old", http.StatusOK},
+		{"older", http.StatusOK},
+		{"oldest", http.StatusUnauthorized},
+	} {
+		w, r := MakeRequest("POST", "/pub/place", "MESSAGE")
+		r.SetBasicAuth(Sha1HMAC(test.key, "/pub/place"), "")
+
+		func() {
+			hookbot := NewWithConfig(TEST_KEY, config)
+			defer hookbot.Shutdown()
+
+			hookbot.ServeHTTP(w, r)
+		}()
+
+		if w.Code != test.expected {
+			t.Errorf("Status code != %v (= %v) for key %q",
+				test.expected, w.Code, test.key)
+		}
+	}
+}
+
+// Tokens restricted by direction, exactness or size only work within those
+// restrictions.
+func TestAuthCapabilities(t *testing.T) {
+	publishExact := Claims{Publish: true, Exact: true}
+	subscribe := Claims{Subscribe: true}
+	subscribeExact := Claims{Subscribe: true, Exact: true}
+	small := Claims{MaxSize: 4}
+
+	for _, test := range []struct {
+		claims         Claims
+		path           string // Token made for.
+		method, target string
+		expected       int
+	}{
+		{publishExact, "/place", "POST", "/pub/place", http.StatusOK},
+		{publishExact, "/place", "POST", "/place", http.StatusOK},
+		{publishExact, "/place/", "POST", "/pub/place/below", http.StatusUnauthorized},
+		{publishExact, "/place", "GET", "/sub/place", http.StatusUnauthorized},
+		{subscribe, "/place", "POST", "/pub/place", http.StatusUnauthorized},
+		{subscribe, "/place/", "GET", "/poll/place/below?timeout=0", http.StatusOK},
+		{subscribeExact, "/place", "GET", "/poll/place?timeout=0", http.StatusOK},
+		{subscribeExact, "/place/", "GET", "/poll/place/?timeout=0", http.StatusUnauthorized},
+		{small, "/place", "POST", "/pub/place", http.StatusRequestEntityTooLarge},
+	} {
+		token, _ := MakeToken(SHA256, TEST_KEY, test.path, test.claims)
+
+		w, r := MakeRequest(test.method, test.target, "MESSAGE")
+		r.SetBasicAuth(token, "")
+
+		func() {
+			hookbot := New(TEST_KEY)
+			defer hookbot.Shutdown()
+
+			hookbot.ServeHTTP(w, r)
+		}()
+
+		if w.Code != test.expected {
+			t.Errorf("Status code != %v (= %v) for %+v",
+				test.expected, w.Code, test)
+		}
+	}
+}
+
+// Revoked tokens are rejected with a distinct message, and the list can be
+// reloaded.
+func TestAuthRevoked(t *testing.T) {
+	token := Sha1HMAC(TEST_KEY, "/pub/place")
+	other := Sha1HMAC(TEST_KEY, "/pub/other")
+
+	path := filepath.Join(t.TempDir(), "revoked")
+	contents := "# Leaked in CI logs\n" + TokenHash(token) + "\n"
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	revocations, err := LoadRevocationList(path)
+	if err != nil {
+		t.Fatalf("LoadRevocationList: %v", err)
+	}
+
+	hookbot := NewWithConfig(TEST_KEY, Config{Revocations: revocations})
+	defer hookbot.Shutdown()
+
+	publish := func(token, target string) *httptest.ResponseRecorder {
+		w, r := MakeRequest("POST", target, "MESSAGE")
+		r.SetBasicAuth(token, "")
+		hookbot.ServeHTTP(w, r)
+		return w
+	}
+
+	w := publish(token, "/pub/place")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Status code != 401 (= %v)", w.Code)
+	}
+	if w.Body.String() != "401 Unauthorized (token revoked)\n" {
+		t.Errorf("Response body incorrect, got: %q", w.Body.String())
+	}
+
+	if w := publish(other, "/pub/other"); w.Code != http.StatusOK {
+		t.Errorf("Status code != 200 (= %v)", w.Code)
+	}
+
+	if err := os.WriteFile(path, []byte(TokenHash(other)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := hookbot.ReloadRevocations(); err != nil {
+		t.Fatalf("ReloadRevocations: %v", err)
+	}
+
+	if w := publish(token, "/pub/place"); w.Code != http.StatusOK {
+		t.Errorf("Status code != 200 after reload (= %v)", w.Code)
+	}
+	if w := publish(other, "/pub/other"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Status code != 401 after reload (= %v)", w.Code)
+	}
+}
+
+func TestAuthClientCertificate(t *testing.T) {
+	hookbot := NewWithConfig(TEST_KEY, Config{
+		ClientIdentities: []ClientIdentity{
+			{Identity: "deploy", Pub: []string{"deploy/"}},
+			{Identity: "ci.example.com", Sub: []string{"builds"}},
+		},
+	})
+	defer hookbot.Shutdown()
+
+	withCert := func(method, target string, cert *x509.Certificate) int {
+		w, r := MakeRequest(method, target, "MESSAGE")
+		r.TLS = &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{cert}},
+		}
+		hookbot.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	deploy := &x509.Certificate{Subject: pkix.Name{CommonName: "deploy"}}
+	ci := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "ci"},
+		DNSNames: []string{"ci.example.com"},
+	}
+
+	for _, tc := range []struct {
+		method, target string
+		cert           *x509.Certificate
+		code           int
+	}{
+		{"POST", "/pub/deploy/prod", deploy, http.StatusOK},
+		{"POST", "/pub/other", deploy, http.StatusUnauthorized},
+		{"POST", "/pub/builds", ci, http.StatusUnauthorized},
+		{"GET", "/sub/builds", ci, http.StatusBadRequest}, // Not a websocket.
+		{"GET", "/sub/builds/more", ci, http.StatusUnauthorized},
+	} {
+		if code := withCert(tc.method, tc.target, tc.cert); code != tc.code {
+			t.Errorf("%v %v as %v: status code != %v (= %v)",
+				tc.method, tc.target, tc.cert.Subject, tc.code, code)
+		}
+	}
+
+	// Without a verified chain, the certificate counts for nothing.
+	w, r := MakeRequest("POST", "/pub/deploy/prod", "MESSAGE")
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{deploy}}
+	hookbot.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Unverified certificate: status code != 401 (= %v)", w.Code)
+	}
+}
@@ -0,0 +1,49 @@
+package hookbot
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// BodySizeLimit limits the size of messages published to topics under Prefix,
+// or just to the topic Prefix if it doesn't end in "/".
+type BodySizeLimit struct {
+	Prefix  string
+	MaxSize int64 // Bytes.
+}
+
+// ParseBodySizeLimit parses a limit of the form "prefix=bytes".
+func ParseBodySizeLimit(s string) (BodySizeLimit, error) {
+	prefix, size, ok := strings.Cut(s, "=")
+	if !ok || prefix == "" {
+		return BodySizeLimit{}, fmt.Errorf("body size limit %q is not of the form prefix=bytes", s)
+	}
+	maxSize, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || maxSize <= 0 {
+		return BodySizeLimit{}, fmt.Errorf("body size limit %q: size must be a positive integer", s)
+	}
+	return BodySizeLimit{Prefix: prefix, MaxSize: maxSize}, nil
+}
+
+// The largest body which may be published by `r`, or 0 if there is no limit.
+// This is the limit for the longest matching prefix, or else the server-wide
+// limit, reduced to the token's limit if that is smaller.
+func (h *Hookbot) maxBodySize(r *http.Request) int64 {
+	topic := strings.TrimPrefix(Topic(r), "/unsafe/")
+
+	maxSize, matched := h.maxBody, ""
+	for _, l := range h.prefixMaxBody {
+		if TopicAllowed([]string{l.Prefix}, topic) && len(l.Prefix) > len(matched) {
+			maxSize, matched = l.MaxSize, l.Prefix
+		}
+	}
+
+	if tokenMax := RequestClaims(r).MaxSize; tokenMax > 0 {
+		if maxSize == 0 || tokenMax < maxSize {
+			maxSize = tokenMax
+		}
+	}
+	return maxSize
+}
@@ -0,0 +1,77 @@
+package hookbot
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"os"
+)
+
+// ClientIdentity lists the topics which a TLS client presenting a verified
+// certificate for Identity may publish and subscribe to. Topics are matched
+// as for JWTs, see TopicAllowed.
+type ClientIdentity struct {
+	// Matched against the certificate's subject, either in full
+	// ("CN=deploy,O=Example") or just its common name, and against its DNS,
+	// email and URI subject alternative names.
+	Identity string `json:"identity"`
+
+	Pub []string `json:"pub"`
+	Sub []string `json:"sub"`
+}
+
+// LoadClientIdentities reads a JSON array of ClientIdentity from `path`.
+func LoadClientIdentities(path string) ([]ClientIdentity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var identities []ClientIdentity
+	err = json.Unmarshal(data, &identities)
+	if err != nil {
+		return nil, err
+	}
+	return identities, nil
+}
+
+// The names by which a certificate can be identified.
+func certificateNames(cert *x509.Certificate) []string {
+	names := []string{cert.Subject.String()}
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// IsClientCertOK returns true if the request was made with a verified TLS
+// client certificate whose identity may access the requested topic.
+func (h *Hookbot) IsClientCertOK(r *http.Request) bool {
+	if len(h.clientIdentities) == 0 || r.TLS == nil ||
+		len(r.TLS.VerifiedChains) == 0 {
+		return false
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	topic, publish := Topic(r), IsPublishRequest(r)
+
+	for _, name := range certificateNames(cert) {
+		for _, identity := range h.clientIdentities {
+			if identity.Identity != name {
+				continue
+			}
+			if publish && TopicAllowed(identity.Pub, topic) {
+				return true
+			}
+			if !publish && TopicAllowed(identity.Sub, topic) {
+				return true
+			}
+		}
+	}
+	return false
+}
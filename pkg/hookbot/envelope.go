@@ -0,0 +1,54 @@
+package hookbot
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Subscribers requesting this websocket subprotocol receive Envelopes.
+const EnvelopeSubprotocol = "hookbot-envelope"
+
+// Envelope is the JSON form of a Message, sent to subscribers which ask for
+// it instead of the bare body.
+type Envelope struct {
+	ID          string    `json:"id"`
+	Seq         uint64    `json:"seq"`
+	Topic       string    `json:"topic"`
+	Timestamp   time.Time `json:"timestamp"`
+	ContentType string    `json:"content_type,omitempty"`
+	Body        []byte    `json:"body"` // Base64 encoded.
+}
+
+func NewEnvelope(m Message) Envelope {
+	return Envelope{
+		ID:          m.ID,
+		Seq:         m.Seq,
+		Topic:       m.Topic,
+		Timestamp:   m.Time,
+		ContentType: m.ContentType,
+		Body:        m.Body,
+	}
+}
+
+// WantsEnvelope returns true if the subscriber negotiated the
+// EnvelopeSubprotocol or specified ?format=envelope.
+func WantsEnvelope(conn *websocket.Conn, r *http.Request) bool {
+	if conn != nil && conn.Subprotocol() == EnvelopeSubprotocol {
+		return true
+	}
+	return r.URL.Query().Get("format") == "envelope"
+}
+
+// NewMessageID returns a random 128 bit identifier, hex encoded.
+func NewMessageID() string {
+	var id [16]byte
+	_, err := rand.Read(id[:])
+	if err != nil {
+		panic(err) // crypto/rand never fails on supported platforms.
+	}
+	return hex.EncodeToString(id[:])
+}
@@ -0,0 +1,68 @@
+package hookbot
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A subscriber which negotiates the envelope subprotocol receives JSON
+// envelopes carrying the message ID, timestamp and content type.
+func TestEnvelopeSubprotocol(t *testing.T) {
+	// The message is published as soon as the websocket is established, which
+	// may be before the subscriber is listening, so replay it from history.
+	hookbot := NewWithConfig(TEST_KEY, Config{HistorySize: 1})
+	defer hookbot.Shutdown()
+
+	server := httptest.NewServer(hookbot)
+	defer server.Close()
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+Sha1HMAC(TEST_KEY, "/sub/foo/"))
+
+	dialer := websocket.Dialer{Subprotocols: []string{EnvelopeSubprotocol}}
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/sub/foo/?since=0"
+	conn, _, err := dialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	if conn.Subprotocol() != EnvelopeSubprotocol {
+		t.Fatalf("Subprotocol not negotiated (= %q)", conn.Subprotocol())
+	}
+
+	w, r := MakeRequest("POST", "/pub/foo/bar", `{"x": 1}`)
+	r.SetBasicAuth(Sha1HMAC(TEST_KEY, "/pub/foo/bar"), "")
+	r.Header.Set("Content-Type", "application/json")
+	hookbot.ServeHTTP(w, r)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var e Envelope
+	if err := conn.ReadJSON(&e); err != nil {
+		t.Fatalf("ReadJSON: %v", err)
+	}
+
+	if e.ID == "" || e.Seq != 1 || e.Timestamp.IsZero() {
+		t.Errorf("Envelope missing ID, Seq or Timestamp: %+v", e)
+	}
+	if e.Topic != "foo/bar" || e.ContentType != "application/json" {
+		t.Errorf("Unexpected topic or content type: %+v", e)
+	}
+	if string(e.Body) != `{"x": 1}` {
+		t.Errorf("Unexpected body: %q", e.Body)
+	}
+
+	// The body is base64 encoded on the wire.
+	var raw map[string]interface{}
+	b, _ := json.Marshal(e)
+	json.Unmarshal(b, &raw)
+	if raw["body"] != "eyJ4IjogMX0=" {
+		t.Errorf("Unexpected encoding of body: %v", raw["body"])
+	}
+}
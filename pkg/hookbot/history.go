@@ -0,0 +1,88 @@
+package hookbot
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// History retains the most recent messages published on each topic so that
+// subscribers which reconnect can catch up on anything they missed.
+// It is safe for concurrent use.
+type History struct {
+	mu     sync.Mutex
+	limit  int // Maximum number of messages kept per topic. 0 disables.
+	topics map[string][]Message
+	ids    map[string]uint64 // Message ID to sequence number.
+}
+
+func NewHistory(limit int) *History {
+	return &History{
+		limit:  limit,
+		topics: map[string][]Message{},
+		ids:    map[string]uint64{},
+	}
+}
+
+// Record `m` in the history for its topic, discarding the oldest message
+// once the topic is at its limit.
+func (h *History) Add(m Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.limit <= 0 {
+		return
+	}
+
+	m.Sent = nil // Nobody is waiting on a replayed message.
+
+	ms := append(h.topics[m.Topic], m)
+	if len(ms) > h.limit {
+		for _, old := range ms[:len(ms)-h.limit] {
+			delete(h.ids, old.ID)
+		}
+		// Copy so that the backing array doesn't grow without bound.
+		ms = append([]Message(nil), ms[len(ms)-h.limit:]...)
+	}
+	h.topics[m.Topic] = ms
+	if m.ID != "" {
+		h.ids[m.ID] = m.Seq
+	}
+}
+
+// SeqOf returns the sequence number of the message with the given ID, if it
+// is still in the history.
+func (h *History) SeqOf(id string) (seq uint64, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	seq, ok = h.ids[id]
+	return seq, ok
+}
+
+// Since returns the messages which a listener on `fullTopic` would have
+// received with a sequence number greater than `since`, oldest first.
+func (h *History) Since(fullTopic string, since uint64) []Message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	collect := func(out, ms []Message) []Message {
+		// Messages for one topic are stored in sequence order.
+		i := sort.Search(len(ms), func(i int) bool { return ms[i].Seq > since })
+		return append(out, ms[i:]...)
+	}
+
+	topic, isRec := recursive(fullTopic)
+	if !isRec {
+		return collect(nil, h.topics[topic])
+	}
+
+	var out []Message
+	for candidate, ms := range h.topics {
+		if strings.HasPrefix(candidate, topic) {
+			out = collect(out, ms)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Seq < out[j].Seq })
+	return out
+}
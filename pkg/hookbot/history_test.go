@@ -0,0 +1,89 @@
+package hookbot
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Messages published before a listener subscribes should be replayed when it
+// asks for them, respecting the recursive topic semantics.
+func TestHistoryReplay(t *testing.T) {
+	hookbot := NewWithConfig(TEST_KEY, Config{HistorySize: 10})
+	defer hookbot.Shutdown()
+
+	for i, topic := range []string{"foo/a", "foo/b", "bar", "foo/a"} {
+		m := Message{Topic: topic, Body: []byte(fmt.Sprint(i))}
+		if !hookbot.Publish(m) {
+			t.Fatalf("Publish %d failed", i)
+		}
+	}
+
+	check := func(topic string, since uint64, expected ...string) {
+		l, replay := hookbot.AddSince(topic, since)
+		defer hookbot.Del(l)
+
+		got := []string{}
+		for _, m := range replay {
+			got = append(got, string(m.Body))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Errorf("AddSince(%q, %d) = %v, expected %v",
+				topic, since, got, expected)
+		}
+	}
+
+	check("foo/a", 0, "0", "3")
+	check("foo/", 0, "0", "1", "3")
+	check("foo/", 2, "3")
+	check("bar", 3)
+	check("baz", 0)
+}
+
+// Only the most recent HistorySize messages for a topic are kept.
+func TestHistoryLimit(t *testing.T) {
+	hookbot := NewWithConfig(TEST_KEY, Config{HistorySize: 2})
+	defer hookbot.Shutdown()
+
+	for i := 0; i < 5; i++ {
+		hookbot.Publish(Message{Topic: "t", Body: []byte(fmt.Sprint(i))})
+	}
+
+	l, replay := hookbot.AddSince("t", 0)
+	defer hookbot.Del(l)
+
+	if len(replay) != 2 {
+		t.Fatalf("len(replay) != 2 (= %d)", len(replay))
+	}
+	if string(replay[0].Body) != "3" || replay[1].Seq != 5 {
+		t.Errorf("Unexpected replay: %+v", replay)
+	}
+}
+
+// Live messages published while a slow client is still writing its replay
+// are buffered rather than dropped.
+func TestHistoryReplayBuffersLive(t *testing.T) {
+	hookbot := NewWithConfig(TEST_KEY, Config{HistorySize: 10})
+	defer hookbot.Shutdown()
+
+	hookbot.Publish(Message{Topic: "foo", Body: []byte("old")})
+
+	l, replay := hookbot.AddSince("foo", 0)
+	defer hookbot.Del(l)
+	if len(replay) != 1 {
+		t.Fatalf("Expected 1 replayed message, got %d", len(replay))
+	}
+
+	// Nothing reads l.c, as if the replay were still being written.
+	for i := 0; i < 5; i++ {
+		hookbot.Publish(Message{Topic: "foo", Body: []byte(fmt.Sprint(i))})
+	}
+
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for len(l.c) < 5 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if len(l.c) != 5 {
+		t.Errorf("Expected 5 buffered live messages, have %d", len(l.c))
+	}
+}
@@ -6,19 +6,30 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unicode"
 
 	"github.com/gorilla/websocket"
 )
 
 type Message struct {
-	Topic string
-	Body  []byte
+	Topic       string
+	Body        []byte
+	ContentType string // As given by the publisher, may be empty.
+
+	// Assigned by Loop when the message is published.
+	// Sequence numbers increase monotonically across all topics, IDs are
+	// unique and Time is the time of publication.
+	Seq  uint64
+	ID   string
+	Time time.Time
 
 	// Returns true if message is in flight, false if dropped.
 	Sent chan bool // Signalled when messages have been strobed.
@@ -29,10 +40,90 @@ type Listener struct {
 	c     chan Message
 	ready chan struct{} // Closed when c is subscribed.
 	dead  chan struct{} // Closed when c disconnects.
+
+	replay *replayRequest // Non-nil if history was requested.
+}
+
+// A replayRequest asks Loop for the history of a Listener's topic at the
+// moment it is subscribed, so that there is no gap between replayed and live
+// messages.
+type replayRequest struct {
+	since    uint64    // Replay messages with a sequence number after this.
+	messages []Message // Filled in by Loop before ready is closed.
+	seq      uint64    // Likewise, the last sequence number published.
+}
+
+// Config holds optional settings for a Hookbot. The zero value is valid.
+type Config struct {
+	// Number of messages retained per topic for replay to subscribers
+	// which ask for them with ?since=. 0 disables history.
+	HistorySize int
+
+	// If non-nil, every published message is appended to Store, and the
+	// history and sequence numbers are restored from it on startup. It is
+	// closed by Shutdown.
+	Store *Store
+
+	// Keys which tokens were previously made with, newest first.
+	// Tokens made with these are still accepted, to allow the key to be
+	// changed without breaking every client at once.
+	OldKeys []string
+
+	// If true, only HMAC-SHA256 tokens are accepted.
+	RejectSHA1 bool
+
+	// If true, only tokens with an expiry time are accepted.
+	RequireExpiry bool
+
+	// If non-nil, tokens in this list are rejected.
+	Revocations *RevocationList
+
+	// If non-nil, JWTs accepted by JWT may be given as bearer tokens.
+	JWT *JWTVerifier
+
+	// Verified TLS client certificates matching these are accepted in place
+	// of a token.
+	ClientIdentities []ClientIdentity
+
+	// Restrict unauthenticated publishing to /unsafe/pub/ by client address.
+	UnsafeAllowlists []Allowlist
+	// Proxies trusted to report client addresses in X-Forwarded-For.
+	TrustedProxies []*net.IPNet
+
+	// Limit the rate of publishing by topic and by client. A zero
+	// ClientRateLimit means no limit.
+	TopicRateLimits []TopicRateLimit
+	ClientRateLimit RateLimit
+
+	// Publishes larger than this many bytes are rejected. Zero means no
+	// limit. BodySizeLimits take precedence for the topics they cover.
+	MaxBodySize    int64
+	BodySizeLimits []BodySizeLimit
+
+	// If set, ?extra-metadata=headers only passes on these headers.
+	MetadataHeaders []string
+
+	// ?extra-metadata=gitlab is only accepted with this X-Gitlab-Token.
+	GitlabSecret string
 }
 
+// How often the Store is checked for segments to expire and compact.
+const storeMaintenancePeriod = 10 * time.Minute
+
 type Hookbot struct {
-	key string
+	keys                      []string // The primary key, then OldKeys.
+	rejectSHA1, requireExpiry bool
+	revocations               *RevocationList
+	jwt                       *JWTVerifier
+	clientIdentities          []ClientIdentity
+	unsafeAllowlists          []Allowlist
+	trustedProxies            []*net.IPNet
+	topicLimiters             []*rateLimiter
+	clientLimiter             *rateLimiter
+	maxBody                   int64
+	prefixMaxBody             []BodySizeLimit
+	metadataAllowlist         []string
+	gitlabSecret              string
 
 	wg       *sync.WaitGroup
 	shutdown chan struct{}
@@ -44,14 +135,42 @@ type Hookbot struct {
 
 	routers []Router
 
+	history *History
+	store   *Store
+	seq     uint64 // Last sequence number assigned. Modified only by Loop.
+
 	// Statistics modified using atomic.AddInt64().
 	// Recorded to the log by ShowStatus().
 	listeners, publish, dropP, sends, dropS int64
+	rejectU                                 int64 // Unsafe publishes rejected by allowlist.
+
+	metrics *metrics
 }
 
 func New(key string) *Hookbot {
+	return NewWithConfig(key, Config{})
+}
+
+func NewWithConfig(key string, config Config) *Hookbot {
 	h := &Hookbot{
-		key: key,
+		keys:          append([]string{key}, config.OldKeys...),
+		rejectSHA1:    config.RejectSHA1,
+		requireExpiry: config.RequireExpiry,
+		revocations:   config.Revocations,
+		jwt:           config.JWT,
+
+		clientIdentities: config.ClientIdentities,
+		unsafeAllowlists: config.UnsafeAllowlists,
+		trustedProxies:   config.TrustedProxies,
+		maxBody:          config.MaxBodySize,
+		prefixMaxBody:    config.BodySizeLimits,
+
+		metadataAllowlist: config.MetadataHeaders,
+		gitlabSecret:      config.GitlabSecret,
+
+		history: NewHistory(config.HistorySize),
+		store:   config.Store,
+		metrics: newMetrics(1 + len(config.OldKeys)),
 
 		wg:       &sync.WaitGroup{},
 		shutdown: make(chan struct{}),
@@ -61,20 +180,39 @@ func New(key string) *Hookbot {
 		delListener: make(chan Listener, 1),
 	}
 
-	sub := WebsocketHandlerFunc(h.ServeSubscribe)
-	pub := http.HandlerFunc(h.ServePublish)
+	sub := h.EventStreamOr(WebsocketHandlerFunc(h.ServeSubscribe))
+	pub := h.RateLimited(http.HandlerFunc(h.ServePublish))
 
 	mux := http.NewServeMux()
 	mux.Handle("/sub/", h.KeyChecker(sub))
 	mux.Handle("/pub/", h.KeyChecker(pub))
+	mux.Handle("/poll/", h.KeyChecker(http.HandlerFunc(h.ServePoll)))
 
 	mux.Handle("/unsafe/sub/", RequireUnsafeHeader(h.KeyChecker(sub)))
-	mux.Handle("/unsafe/pub/", pub)
+	mux.Handle("/unsafe/pub/", h.UnsafeAllowlistChecker(pub))
 
 	mux.Handle("/", h.KeyChecker(h.BothPubSub(pub, sub)))
 
 	h.Handler = mux
 
+	for _, l := range config.TopicRateLimits {
+		h.topicLimiters = append(h.topicLimiters, newRateLimiter(l.Prefix, l.RateLimit))
+	}
+	if config.ClientRateLimit.Rate > 0 {
+		h.clientLimiter = newRateLimiter("", config.ClientRateLimit)
+	}
+
+	if h.store != nil {
+		h.seq = h.store.LastSeq()
+		err := h.store.Replay(h.history.Add)
+		if err != nil {
+			log.Printf("Error restoring history from store: %v", err)
+		}
+
+		h.wg.Add(1)
+		go h.MaintainStore(config.HistorySize, storeMaintenancePeriod)
+	}
+
 	h.wg.Add(1)
 	go h.Loop()
 
@@ -104,7 +242,13 @@ func (h *Hookbot) BothPubSub(pub, sub http.Handler) http.Handler {
 func (h *Hookbot) ShowStatus(period time.Duration) {
 	defer h.wg.Done()
 	ticker := time.NewTicker(period)
-	var ll, lp, ls, ldP, ldS int64
+	var ll, lp, ls, ldP, ldS, lrU int64
+
+	limiters := h.rateLimiters()
+	lastRejected := make([]int64, len(limiters))
+	for _, l := range limiters {
+		log.Printf("Rate limit {%s}: %v", l.labels(), l.limit)
+	}
 
 	for {
 		select {
@@ -114,12 +258,46 @@ func (h *Hookbot) ShowStatus(period time.Duration) {
 			s := atomic.LoadInt64(&h.sends)
 			dP := atomic.LoadInt64(&h.dropP)
 			dS := atomic.LoadInt64(&h.dropS)
+			rU := atomic.LoadInt64(&h.rejectU)
 
 			log.Printf("Listeners %5d [%+5d] pub %5d [%+5d] (d %5d [%+5d])"+
-				" send %8d [%+7d] (d %5d [%+5d])",
-				l, l-ll, p, p-lp, dP, dP-ldP, s, s-ls, dS, dS-ldS)
+				" send %8d [%+7d] (d %5d [%+5d]) unsafe rejected %5d [%+5d]",
+				l, l-ll, p, p-lp, dP, dP-ldP, s, s-ls, dS, dS-ldS, rU, rU-lrU)
+
+			ll, lp, ls, ldP, ldS, lrU = l, p, s, dP, dS, rU
+
+			for i, l := range limiters {
+				r := atomic.LoadInt64(&l.rejected)
+				if r != lastRejected[i] {
+					log.Printf("Rate limit {%s}: rejected %5d [%+5d]",
+						l.labels(), r, r-lastRejected[i])
+				}
+				lastRejected[i] = r
+			}
+		case <-h.shutdown:
+			return
+		}
+	}
+}
 
-			ll, lp, ls, ldP, ldS = l, p, s, dP, dS
+// Every `period`, remove messages from the store which are outside of its
+// retention limits or which are no longer needed to rebuild the history.
+func (h *Hookbot) MaintainStore(historySize int, period time.Duration) {
+	defer h.wg.Done()
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := h.store.Expire(time.Now())
+			if err != nil {
+				log.Printf("Error expiring store: %v", err)
+			}
+			err = h.store.Compact(historySize)
+			if err != nil {
+				log.Printf("Error compacting store: %v", err)
+			}
 		case <-h.shutdown:
 			return
 		}
@@ -130,6 +308,13 @@ func (h *Hookbot) ShowStatus(period time.Duration) {
 func (h *Hookbot) Shutdown() {
 	close(h.shutdown)
 	h.wg.Wait()
+
+	if h.store != nil {
+		err := h.store.Close()
+		if err != nil {
+			log.Printf("Error closing store: %v", err)
+		}
+	}
 }
 
 // Returns "true" if fullTopic ends with a "/".
@@ -223,44 +408,34 @@ func (h *Hookbot) Loop() {
 		}
 	}()
 
-	listeners := map[string]map[Listener]struct{}{}
-
-	// Determine the set of interested listeners for a given topic.
-	interested := func(topic string) map[Listener]struct{} {
-		ls := map[Listener]struct{}{}
-
-		for l := range listeners[topic] {
-			ls[l] = struct{}{}
-		}
-
-		for fullCandidateTopic, candidateLs := range listeners {
-			candidateTopic, isRec := recursive(fullCandidateTopic)
-			if !isRec {
-				continue
-			}
-
-			if !strings.HasPrefix(topic, candidateTopic) {
-				continue
-			}
-			for l := range candidateLs {
-				ls[l] = struct{}{}
-			}
-		}
-		return ls
-	}
+	listeners := NewTopicTrie()
 
 	for {
 		select {
 		case m := <-h.message:
 			// Main message send.
+			m.Seq = atomic.LoadUint64(&h.seq) + 1
+			m.ID = NewMessageID()
+			m.Time = time.Now().UTC()
+
+			interested := listeners.Interested(m.Topic)
+			h.metrics.fanout.Observe(float64(len(interested)))
 
 			select {
-			case cMessageListeners <- MessageListeners{interested(m.Topic), &m}:
+			case cMessageListeners <- MessageListeners{interested, &m}:
 				// A message making it onto `cMessageListeners` is considered
 				// "sent" in that it has successfully entered the queue to be
 				// sent. It can still be dropped if a receiver is sufficiently
 				// slow to free up buffer space for the message.
 				atomic.AddInt64(&h.publish, 1)
+				atomic.StoreUint64(&h.seq, m.Seq)
+				h.history.Add(m)
+				if h.store != nil {
+					err := h.store.Append(m)
+					if err != nil {
+						log.Printf("Error appending to store: %v", err)
+					}
+				}
 				m.Sent <- true
 			default:
 				// In this case, the `cMessageListeners` buffer is full.
@@ -274,20 +449,18 @@ func (h *Hookbot) Loop() {
 			// New listener appears
 			atomic.AddInt64(&h.listeners, 1)
 
-			if _, ok := listeners[l.Topic]; !ok {
-				listeners[l.Topic] = map[Listener]struct{}{}
+			listeners.Add(l)
+			if l.replay != nil {
+				l.replay.messages = h.history.Since(l.Topic, l.replay.since)
+				l.replay.seq = atomic.LoadUint64(&h.seq)
 			}
-			listeners[l.Topic][l] = struct{}{}
 			close(l.ready)
 
 		case l := <-h.delListener:
 			// Listener disappears
 			atomic.AddInt64(&h.listeners, -1)
 
-			delete(listeners[l.Topic], l)
-			if len(listeners[l.Topic]) == 0 {
-				delete(listeners, l.Topic)
-			}
+			listeners.Del(l)
 
 		case <-h.shutdown:
 			// Signalled to shut down cleanly.
@@ -298,13 +471,38 @@ func (h *Hookbot) Loop() {
 
 // Return a new Listener which receives messages for `topic`.
 func (h *Hookbot) Add(topic string) Listener {
+	return h.add(topic, nil)
+}
+
+// AddSince is like Add, but also returns the messages in the history for
+// `topic` with a sequence number greater than `since`. Anything published
+// after those is delivered to the Listener as usual.
+func (h *Hookbot) AddSince(topic string, since uint64) (Listener, []Message) {
+	replay := &replayRequest{since: since}
+	l := h.add(topic, replay)
+	return l, replay.messages
+}
+
+// Listeners which replay history buffer up to this many live messages, which
+// arrive while the replay is being written to the client, rather than dropping
+// them after `timeout`.
+const replayLiveBuffer = 1000
+
+func (h *Hookbot) add(topic string, replay *replayRequest) Listener {
+	buffer := 1
+	if replay != nil {
+		buffer = replayLiveBuffer
+	}
+
 	ready := make(chan struct{})
 	l := Listener{
 		Topic: topic,
 
-		c:     make(chan Message, 1),
+		c:     make(chan Message, buffer),
 		ready: ready,
 		dead:  make(chan struct{}),
+
+		replay: replay,
 	}
 	h.addListener <- l
 	<-ready
@@ -318,9 +516,20 @@ func (h *Hookbot) AddRouter(r Router) {
 		go func() {
 			defer h.wg.Done()
 
+			stats := h.metrics.router(r.Name())
+			publish := func(m Message) bool {
+				ok := h.Publish(m)
+				if ok {
+					atomic.AddInt64(&stats.routed, 1)
+				} else {
+					atomic.AddInt64(&stats.failed, 1)
+				}
+				return ok
+			}
+
 			l := h.Add(topic)
 			for m := range l.c {
-				r.Route(m, h.Publish)
+				r.Route(m, publish)
 			}
 		}()
 	}
@@ -332,9 +541,9 @@ func (h *Hookbot) Del(l Listener) {
 	h.delListener <- l
 }
 
-// The topic is everything after the "/pub/" or "/sub/"
+// The topic is everything after the "/pub/", "/sub/" or "/poll/"
 // Do not capture the "/unsafe". See note in `Topic()`.
-var TopicRE *regexp.Regexp = regexp.MustCompile("^(?:/unsafe)?/(?:pub|sub)/(.*)$")
+var TopicRE *regexp.Regexp = regexp.MustCompile("^(?:(?:/unsafe)?/(?:pub|sub)|/poll)/(.*)$")
 
 func Topic(r *http.Request) string {
 	if !TopicRE.MatchString(r.URL.Path) {
@@ -357,48 +566,75 @@ func Topic(r *http.Request) string {
 func (h *Hookbot) ServePublish(w http.ResponseWriter, r *http.Request) {
 
 	topic := Topic(r)
+	if !ValidTopic(topic) {
+		http.Error(w, "400 Bad Request (invalid topic)", http.StatusBadRequest)
+		return
+	}
 
 	var (
 		body []byte
 		err  error
 	)
 
+	contentType := r.Header.Get("Content-Type")
+
+	maxSize := h.maxBodySize(r)
+	if maxSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	}
+
 	body, err = ioutil.ReadAll(r.Body)
+	if _, ok := err.(*http.MaxBytesError); ok {
+		http.Error(w, "413 Request Entity Too Large",
+			http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		log.Println("Error in ServePublish reading body:", err)
 		http.Error(w, "500 Internal Server Error",
 			http.StatusInternalServerError)
 		return
 	}
+	atomic.AddInt64(&h.metrics.bytesIn, int64(len(body)))
 
 	extraMetadata := r.URL.Query()["extra-metadata"]
+	if len(extraMetadata) > 0 && extraMetadata[0] == "gitlab" && !h.gitlabTokenOK(r) {
+		http.Error(w, "403 Forbidden (bad X-Gitlab-Token)", http.StatusForbidden)
+		return
+	}
 	if len(extraMetadata) > 0 {
-		switch extraMetadata[0] {
-		case "github":
+		metadata, ok := h.ExtraMetadata(extraMetadata[0], r, body)
+		if !ok {
+			http.Error(w, "400 Bad Request (bad ?extra-metadata=)",
+				http.StatusBadRequest)
+			return
+		}
 
-			body, err = json.Marshal(map[string]interface{}{
-				"Signature": r.Header.Get("X-Hub-Signature"),
-				"Event":     r.Header.Get("X-GitHub-Event"),
-				"Delivery":  r.Header.Get("X-GitHub-Delivery"),
-				"Payload":   body,
-			})
+		body, err = json.Marshal(metadata)
+		contentType = "application/json"
 
-			if err != nil {
-				log.Println("Error in ServePublish serializing payload:", err)
-				http.Error(w, "500 Internal Server Error",
-					http.StatusInternalServerError)
-			}
+		if err != nil {
+			log.Println("Error in ServePublish serializing payload:", err)
+			http.Error(w, "500 Internal Server Error",
+				http.StatusInternalServerError)
+			return
+		}
 
-		default:
-			http.Error(w, "400 Bad Request (bad ?extra-metadata=)",
-				http.StatusBadRequest)
+		// The limit applies to what subscribers receive, which has grown.
+		if maxSize > 0 && int64(len(body)) > maxSize {
+			http.Error(w, "413 Request Entity Too Large",
+				http.StatusRequestEntityTooLarge)
 			return
 		}
 	}
 
 	log.Printf("Publish %q", topic)
 
-	ok := h.Publish(Message{Topic: topic, Body: body})
+	ok := h.Publish(Message{
+		Topic:       topic,
+		Body:        body,
+		ContentType: contentType,
+	})
 
 	if !ok {
 		http.Error(w, "Timeout in send", http.StatusServiceUnavailable)
@@ -408,8 +644,25 @@ func (h *Hookbot) ServePublish(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "OK")
 }
 
-// Blocks until message has been published.
+// ValidTopic returns false for topics containing control characters, which
+// could break the framing of subscribers' streams.
+func ValidTopic(topic string) bool {
+	return strings.IndexFunc(topic, unicode.IsControl) == -1
+}
+
+// Blocks until message has been published. Messages with an invalid topic
+// are dropped.
 func (h *Hookbot) Publish(m Message) bool {
+	if !ValidTopic(m.Topic) {
+		log.Printf("Dropping message with invalid topic %q", m.Topic)
+		return false
+	}
+
+	start := time.Now()
+	defer func() {
+		h.metrics.publishLatency.Observe(time.Since(start).Seconds())
+	}()
+
 	sent := make(chan bool)
 	m.Sent = sent
 
@@ -423,11 +676,47 @@ func (h *Hookbot) Publish(m Message) bool {
 	return <-sent
 }
 
+// Since returns the sequence number given by the ?since= query parameter.
+// ok is false if the parameter is absent.
+func Since(r *http.Request) (since uint64, ok bool, err error) {
+	values, ok := r.URL.Query()["since"]
+	if !ok {
+		return 0, false, nil
+	}
+	since, err = strconv.ParseUint(values[0], 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("bad ?since=%q: %v", values[0], err)
+	}
+	return since, true, nil
+}
+
 // Subscribe to message via HTTP websocket.
+// If ?since=N is specified, messages from the history with a sequence number
+// greater than N are sent before live messages.
+// Messages are sent as JSON Envelopes if the client asks for them, see
+// WantsEnvelope.
 func (h *Hookbot) ServeSubscribe(conn *websocket.Conn, r *http.Request) {
 	topic := Topic(r)
 
-	listener := h.Add(topic)
+	since, haveSince, err := Since(r)
+	if err != nil {
+		msg := websocket.FormatCloseMessage(websocket.CloseUnsupportedData,
+			err.Error())
+		conn.WriteControl(websocket.CloseMessage, msg,
+			time.Now().Add(time.Second))
+		conn.Close()
+		return
+	}
+
+	var (
+		listener Listener
+		replay   []Message
+	)
+	if haveSince {
+		listener, replay = h.AddSince(topic, since)
+	} else {
+		listener = h.Add(topic)
+	}
 	defer h.Del(listener)
 
 	closed := make(chan struct{})
@@ -442,19 +731,21 @@ func (h *Hookbot) ServeSubscribe(conn *websocket.Conn, r *http.Request) {
 		}
 	}()
 
-	var message Message
-
-	for {
-		select {
-		case message = <-listener.c:
-		case <-closed:
-			return
-		}
+	_, isRecursive := recursive(topic)
+	envelope := WantsEnvelope(conn, r)
 
+	// Returns false if the connection should be abandoned.
+	send := func(message Message) bool {
 		conn.SetWriteDeadline(time.Now().Add(90 * time.Second))
-		_, isRecursive := recursive(topic)
 		msgBytes := []byte{}
-		if isRecursive {
+		if envelope {
+			var err error
+			msgBytes, err = json.Marshal(NewEnvelope(message))
+			if err != nil {
+				log.Printf("Error marshalling envelope: %v", err)
+				return false
+			}
+		} else if isRecursive {
 			msgBytes = append(msgBytes, message.Topic...)
 			msgBytes = append(msgBytes, '\x00')
 			msgBytes = append(msgBytes, message.Body...)
@@ -462,11 +753,37 @@ func (h *Hookbot) ServeSubscribe(conn *websocket.Conn, r *http.Request) {
 			msgBytes = message.Body
 		}
 		err := conn.WriteMessage(websocket.BinaryMessage, msgBytes)
+		if err != nil {
+			atomic.AddInt64(&h.metrics.wsWriteErrors, 1)
+		} else {
+			atomic.AddInt64(&h.metrics.bytesOut, int64(len(msgBytes)))
+		}
 		switch {
 		case err == io.EOF || IsConnectionClose(err):
-			return
+			return false
 		case err != nil:
 			log.Printf("Error in conn.WriteMessage: %v", err)
+			return false
+		}
+		return true
+	}
+
+	for _, message := range replay {
+		if !send(message) {
+			return
+		}
+	}
+
+	var message Message
+
+	for {
+		select {
+		case message = <-listener.c:
+		case <-closed:
+			return
+		}
+
+		if !send(message) {
 			return
 		}
 	}
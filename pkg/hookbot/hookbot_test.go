@@ -1,6 +1,15 @@
 package hookbot
 
-import "testing"
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sensiblecodeio/hookbot/pkg/listen"
+)
 
 // TestPubSub checks that messages are delivered when (pub|sub) is absent.
 func TestPubSub(t *testing.T) {
@@ -32,3 +41,146 @@ func TestPubSub(t *testing.T) {
 
 	checkDelivered(messages, "MESSAGE")
 }
+
+// The server-wide body size limit is overridden by prefix, and reduced by a
+// token's own limit. It applies to the body after any ?extra-metadata=.
+func TestPublishMaxBodySize(t *testing.T) {
+	hookbot := NewWithConfig(TEST_KEY, Config{
+		MaxBodySize:    8,
+		BodySizeLimits: []BodySizeLimit{{Prefix: "big/", MaxSize: 16}},
+	})
+	defer hookbot.Shutdown()
+
+	publish := func(target, body, token string) int {
+		w, r := MakeRequest("POST", target, body)
+		if token != "" {
+			r.SetBasicAuth(token, "")
+		}
+		hookbot.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	small := Claims{MaxSize: 4}.String()
+	smallToken := small + "." + Sha256HMAC(TEST_KEY, tokenPayload("/pub/big/", small))
+
+	for _, tc := range []struct {
+		target, body, token string
+		code                int
+	}{
+		{"/unsafe/pub/foo", "12345678", "", http.StatusOK},
+		{"/unsafe/pub/foo", "123456789", "", http.StatusRequestEntityTooLarge},
+		{"/unsafe/pub/big/foo", "123456789", "", http.StatusOK},
+		{"/unsafe/pub/big/foo", "12345678901234567", "", http.StatusRequestEntityTooLarge},
+		{"/pub/big/foo", "12345", smallToken, http.StatusRequestEntityTooLarge},
+		{"/unsafe/pub/foo?extra-metadata=headers", "1234", "", http.StatusRequestEntityTooLarge},
+	} {
+		if code := publish(tc.target, tc.body, tc.token); code != tc.code {
+			t.Errorf("Publish %d bytes to %v: status code != %v (= %v)",
+				len(tc.body), tc.target, tc.code, code)
+		}
+	}
+}
+
+// ?extra-metadata=gitlab only accepts the configured secret token, and wraps
+// the payload with a signature in place of the token.
+func TestPublishGitlabMetadata(t *testing.T) {
+	hookbot := NewWithConfig(TEST_KEY, Config{GitlabSecret: "s3cret"})
+	defer hookbot.Shutdown()
+
+	messages := hookbot.Add("/unsafe/gitlab.com/hook").c
+
+	publish := func(token string) int {
+		w, r := MakeRequest("POST", "/unsafe/pub/gitlab.com/hook?extra-metadata=gitlab", `{"object_kind": "push"}`)
+		if token != "" {
+			r.Header.Set("X-Gitlab-Token", token)
+		}
+		r.Header.Set("X-Gitlab-Event", "Push Hook")
+		hookbot.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		if code := publish(token); code != http.StatusForbidden {
+			t.Errorf("Token %q: status code != 403 (= %v)", token, code)
+		}
+	}
+	if code := publish("s3cret"); code != http.StatusOK {
+		t.Fatalf("Status code != 200 (= %v)", code)
+	}
+
+	m := <-messages
+	if strings.Contains(string(m.Body), "s3cret") {
+		t.Errorf("Token leaked into message: %s", m.Body)
+	}
+
+	var wrapped struct {
+		Signature, Event string
+		Payload          []byte
+	}
+	if err := json.Unmarshal(m.Body, &wrapped); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if wrapped.Signature != GitlabSignature(TEST_KEY, wrapped.Payload) ||
+		wrapped.Event != "Push Hook" ||
+		string(wrapped.Payload) != `{"object_kind": "push"}` {
+		t.Errorf("Unexpected message: %+v", wrapped)
+	}
+}
+
+// ?extra-metadata=headers wraps the request so that it decodes as a
+// listen.Message, from the address behind a trusted proxy, without private
+// headers or headers outside the allowlist.
+func TestPublishHeadersMetadata(t *testing.T) {
+	for _, tc := range []struct {
+		allowlist []string
+		expected  http.Header
+	}{
+		{nil, http.Header{
+			"Stripe-Signature": {"t=1,v1=abc"},
+			"X-Other":          {"other"},
+			"X-Forwarded-For":  {"198.51.100.7"},
+		}},
+		{[]string{"stripe-signature", "authorization", "x-gitlab-token"}, http.Header{
+			"Stripe-Signature": {"t=1,v1=abc"},
+		}},
+	} {
+		_, proxy, _ := net.ParseCIDR("192.0.2.0/24")
+		hookbot := NewWithConfig(TEST_KEY, Config{
+			MetadataHeaders: tc.allowlist,
+			TrustedProxies:  []*net.IPNet{proxy},
+		})
+		messages := hookbot.Add("stripe").c
+
+		w, r := MakeRequest("POST", "/pub/stripe?extra-metadata=headers&x=1", "BODY")
+		r.SetBasicAuth(Sha1HMAC(TEST_KEY, "/pub/stripe"), "")
+		r.Header.Set("Stripe-Signature", "t=1,v1=abc")
+		r.Header.Set("X-Other", "other")
+		r.Header.Set("X-Gitlab-Token", "s3cret")
+		r.Header.Set("Proxy-Authorization", "Basic cHJveHk6cHc=")
+		r.Header.Set("X-Forwarded-For", "198.51.100.7")
+		r.RemoteAddr = "192.0.2.1:1234"
+		hookbot.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Status code != 200 (= %v)", w.Code)
+		}
+
+		m := <-messages
+		hookbot.Shutdown()
+
+		var decoded listen.Message
+		if err := json.Unmarshal(m.Body, &decoded); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		body, _ := decoded.Payload()
+
+		if decoded.Method != "POST" || decoded.URL.Path != "/pub/stripe" ||
+			decoded.URL.RawQuery != "extra-metadata=headers&x=1" ||
+			decoded.RemoteAddr != "198.51.100.7" || string(body) != "BODY" {
+			t.Errorf("Unexpected message: %s", m.Body)
+		}
+		if !reflect.DeepEqual(decoded.Header, tc.expected) {
+			t.Errorf("Allowlist %v: headers %v, expected %v",
+				tc.allowlist, decoded.Header, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package hookbot
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// JWTVerifier accepts JSON Web Tokens as an alternative to path HMACs, so that
+// another service can grant access to hookbot without knowing its key.
+// Tokens must be signed with HS256 using the configured secret, or with RS256
+// or ES256 using the configured public key.
+type JWTVerifier struct {
+	secret    []byte
+	publicKey crypto.PublicKey // *rsa.PublicKey or *ecdsa.PublicKey.
+}
+
+// JWTClaims are the claims hookbot understands. Topics are matched as for
+// subscriptions: an entry ending in "/" allows every topic below it,
+// otherwise it allows exactly that topic.
+type JWTClaims struct {
+	Subject   string `json:"sub"`
+	Expires   int64  `json:"exp"` // Required.
+	NotBefore int64  `json:"nbf"`
+
+	Topics struct {
+		Pub []string `json:"pub"`
+		Sub []string `json:"sub"`
+	} `json:"topics"`
+}
+
+// NewJWTVerifier returns a verifier for tokens signed with `secret` (if not
+// empty) or the public key in the PEM file at `publicKeyPath` (if not empty).
+func NewJWTVerifier(secret, publicKeyPath string) (*JWTVerifier, error) {
+	v := &JWTVerifier{}
+	if secret != "" {
+		v.secret = []byte(secret)
+	}
+
+	if publicKeyPath != "" {
+		pemBytes, err := os.ReadFile(publicKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		v.publicKey, err = parsePublicKey(pemBytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", publicKeyPath, err)
+		}
+	}
+
+	if v.secret == nil && v.publicKey == nil {
+		return nil, fmt.Errorf("JWT verifier needs a secret or a public key")
+	}
+	return v, nil
+}
+
+func parsePublicKey(pemBytes []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			return key, nil
+		case *ecdsa.PublicKey:
+			if key.Curve != elliptic.P256() {
+				return nil, fmt.Errorf("ES256 requires a P-256 key")
+			}
+			return key, nil
+		}
+		return nil, fmt.Errorf("unsupported public key type %T", key)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
+
+// LooksLikeJWT returns true if `token` has the three part structure of a JWT,
+// as opposed to a hookbot token.
+func LooksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Verify checks the signature and validity period of `token`.
+func (v *JWTVerifier) Verify(token string, now time.Time) (*JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil {
+		return nil, fmt.Errorf("bad JWT header: %v", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("bad JWT signature encoding: %v", err)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	err = v.verifySignature(header.Alg, signed, signature)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims JWTClaims
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		return nil, fmt.Errorf("bad JWT claims: %v", err)
+	}
+
+	switch {
+	case claims.Expires == 0:
+		return nil, fmt.Errorf("JWT has no expiry")
+	case now.Unix() >= claims.Expires:
+		return nil, fmt.Errorf("JWT expired")
+	case claims.NotBefore != 0 && now.Unix() < claims.NotBefore:
+		return nil, fmt.Errorf("JWT not yet valid")
+	}
+	return &claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(decoded, v)
+}
+
+// The algorithm is only accepted if it matches the kind of key configured,
+// so that a token can't, for example, be HS256 signed with the public key.
+func (v *JWTVerifier) verifySignature(alg string, signed, signature []byte) error {
+	hash := sha256.Sum256(signed)
+
+	switch alg {
+	case "HS256":
+		if v.secret == nil {
+			break
+		}
+		mac := hmac.New(sha256.New, v.secret)
+		_, _ = mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return fmt.Errorf("bad JWT signature")
+		}
+		return nil
+
+	case "RS256":
+		key, ok := v.publicKey.(*rsa.PublicKey)
+		if !ok {
+			break
+		}
+		err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature)
+		if err != nil {
+			return fmt.Errorf("bad JWT signature")
+		}
+		return nil
+
+	case "ES256":
+		key, ok := v.publicKey.(*ecdsa.PublicKey)
+		if !ok {
+			break
+		}
+		if len(signature) != 64 {
+			return fmt.Errorf("bad JWT signature length")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(key, hash[:], r, s) {
+			return fmt.Errorf("bad JWT signature")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("JWT algorithm %q not accepted", alg)
+}
+
+// Allows returns true if the claims permit `r`.
+func (c *JWTClaims) Allows(r *http.Request) bool {
+	if IsPublishRequest(r) {
+		return TopicAllowed(c.Topics.Pub, Topic(r))
+	}
+	return TopicAllowed(c.Topics.Sub, Topic(r))
+}
+
+// TopicAllowed returns true if `topic` is covered by one of `allowed`. Entries
+// ending in "/" cover every topic beginning with them, others cover only
+// themselves.
+func TopicAllowed(allowed []string, topic string) bool {
+	for _, a := range allowed {
+		if a == topic {
+			return true
+		}
+		if strings.HasSuffix(a, "/") && strings.HasPrefix(topic, a) {
+			return true
+		}
+	}
+	return false
+}
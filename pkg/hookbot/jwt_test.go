@@ -0,0 +1,117 @@
+package hookbot
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func makeJWT(alg string, claims interface{}, sign func([]byte) []byte) string {
+	enc := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	return signed + "." + enc.EncodeToString(sign([]byte(signed)))
+}
+
+func signHS256(secret string) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+func signES256(key *ecdsa.PrivateKey) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		hash := sha256.Sum256(signed)
+		r, s, _ := ecdsa.Sign(rand.Reader, key, hash[:])
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig
+	}
+}
+
+func TestJWT(t *testing.T) {
+	const secret = "jwt_secret"
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	keyPath := filepath.Join(t.TempDir(), "jwt.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if err := os.WriteFile(keyPath, pemBytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	verifier, err := NewJWTVerifier(secret, keyPath)
+	if err != nil {
+		t.Fatalf("NewJWTVerifier: %v", err)
+	}
+
+	claims := map[string]interface{}{
+		"sub":    "ci",
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"topics": map[string][]string{"pub": {"deploy/"}, "sub": {"status"}},
+	}
+	expired := map[string]interface{}{
+		"exp":    time.Now().Add(-time.Hour).Unix(),
+		"topics": map[string][]string{"pub": {"deploy/"}},
+	}
+
+	hs256 := makeJWT("HS256", claims, signHS256(secret))
+	es256 := makeJWT("ES256", claims, signES256(key))
+
+	for _, test := range []struct {
+		token, method, target string
+		expected              int
+	}{
+		{hs256, "POST", "/pub/deploy/app", http.StatusOK},
+		{es256, "POST", "/pub/deploy/app", http.StatusOK},
+		{hs256, "POST", "/pub/status", http.StatusUnauthorized},
+		{hs256, "GET", "/poll/status?timeout=0", http.StatusOK},
+		{hs256, "GET", "/poll/deploy/app?timeout=0", http.StatusUnauthorized},
+		{makeJWT("HS256", claims, signHS256("wrong")), "POST", "/pub/deploy/app", http.StatusUnauthorized},
+		{makeJWT("HS256", expired, signHS256(secret)), "POST", "/pub/deploy/app", http.StatusUnauthorized},
+		{makeJWT("none", claims, func([]byte) []byte { return nil }), "POST", "/pub/deploy/app", http.StatusUnauthorized},
+	} {
+		w, r := MakeRequest(test.method, test.target, "MESSAGE")
+		r.Header.Set("Authorization", "Bearer "+test.token)
+
+		func() {
+			hookbot := NewWithConfig(TEST_KEY, Config{JWT: verifier})
+			defer hookbot.Shutdown()
+
+			hookbot.ServeHTTP(w, r)
+		}()
+
+		if w.Code != test.expected {
+			t.Errorf("Status code != %v (= %v) for %s %s",
+				test.expected, w.Code, test.method, test.target)
+		}
+	}
+
+	// JWTs aren't accepted as the basic auth username.
+	w, r := MakeRequest("POST", "/pub/deploy/app", "MESSAGE")
+	r.SetBasicAuth(hs256, "")
+	func() {
+		hookbot := NewWithConfig(TEST_KEY, Config{JWT: verifier})
+		defer hookbot.Shutdown()
+
+		hookbot.ServeHTTP(w, r)
+	}()
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("JWT as basic auth: status code != 401 (= %v)", w.Code)
+	}
+}
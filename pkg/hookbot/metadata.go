@@ -0,0 +1,119 @@
+package hookbot
+
+import "net/http"
+
+// Headers never passed on by ?extra-metadata=headers, even if allowlisted,
+// since they carry credentials for hookbot, a proxy or the sender.
+var privateHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"X-Gitlab-Token",
+}
+
+// ExtraMetadata wraps a webhook's payload with the headers which its sender
+// puts information in, for ?extra-metadata=<kind>. Returns false if kind is
+// not understood.
+func (h *Hookbot) ExtraMetadata(kind string, r *http.Request, payload []byte) (map[string]interface{}, bool) {
+	switch kind {
+	case "headers":
+		remoteAddr := r.RemoteAddr
+		if ip := ClientIP(r, h.trustedProxies); ip != nil {
+			remoteAddr = ip.String()
+		}
+		// Decodes as a listen.Message. The body is a JSON string, so any
+		// bytes which aren't valid UTF-8 become U+FFFD; senders of binary
+		// payloads should use another kind.
+		return map[string]interface{}{
+			"Method":     r.Method,
+			"URL":        r.URL.Path,
+			"Query":      r.URL.RawQuery,
+			"RemoteAddr": remoteAddr,
+			"Header":     h.metadataHeaders(r.Header),
+			"Body":       string(payload),
+		}, true
+
+	case "github":
+		return map[string]interface{}{
+			"Signature":    r.Header.Get("X-Hub-Signature"),
+			"Signature256": r.Header.Get("X-Hub-Signature-256"),
+			"Event":        r.Header.Get("X-GitHub-Event"),
+			"Delivery":     r.Header.Get("X-GitHub-Delivery"),
+			"Payload":      payload,
+		}, true
+
+	case "gitlab":
+		// ServePublish has checked the token, which is a shared secret, so
+		// a MAC of the payload is passed on in its place.
+		return map[string]interface{}{
+			"Signature": GitlabSignature(h.keys[0], payload),
+			"Event":     r.Header.Get("X-Gitlab-Event"),
+			"EventUUID": r.Header.Get("X-Gitlab-Event-UUID"),
+			"Instance":  r.Header.Get("X-Gitlab-Instance"),
+			"Payload":   payload,
+		}, true
+
+	case "gitea":
+		// Forgejo sends both its own headers and Gitea's.
+		return map[string]interface{}{
+			"Signature": firstHeader(r, "X-Gitea-Signature", "X-Forgejo-Signature"),
+			"Event":     firstHeader(r, "X-Gitea-Event", "X-Forgejo-Event"),
+			"Delivery":  firstHeader(r, "X-Gitea-Delivery", "X-Forgejo-Delivery"),
+			"Payload":   payload,
+		}, true
+
+	case "bitbucket":
+		return map[string]interface{}{
+			"Signature": r.Header.Get("X-Hub-Signature"),
+			"Event":     r.Header.Get("X-Event-Key"),
+			"Delivery":  r.Header.Get("X-Request-UUID"),
+			"Payload":   payload,
+		}, true
+	}
+	return nil, false
+}
+
+// Returns true if `r` has the X-Gitlab-Token configured as GitlabSecret. If
+// none is configured, no token is accepted.
+func (h *Hookbot) gitlabTokenOK(r *http.Request) bool {
+	return h.gitlabSecret != "" &&
+		SecureEqual(r.Header.Get("X-Gitlab-Token"), h.gitlabSecret)
+}
+
+// GitlabSignature is the MAC which ?extra-metadata=gitlab gives payloads, so
+// that the gitlab router can tell them from messages published without a
+// valid token. The prefix means it can never be a valid token itself, since
+// token paths start with "/".
+func GitlabSignature(key string, payload []byte) string {
+	return Sha256HMAC(key, "gitlab\x00"+string(payload))
+}
+
+// The value of the first of `names` which is set.
+func firstHeader(r *http.Request, names ...string) string {
+	for _, name := range names {
+		if value := r.Header.Get(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// The headers to pass on with ?extra-metadata=headers: those in the configured
+// allowlist if there is one, otherwise all of them, less privateHeaders.
+func (h *Hookbot) metadataHeaders(header http.Header) http.Header {
+	out := http.Header{}
+	if len(h.metadataAllowlist) > 0 {
+		for _, name := range h.metadataAllowlist {
+			if values := header.Values(name); len(values) > 0 {
+				out[http.CanonicalHeaderKey(name)] = values
+			}
+		}
+	} else {
+		out = header.Clone()
+	}
+
+	for _, name := range privateHeaders {
+		out.Del(name)
+	}
+	return out
+}
@@ -0,0 +1,198 @@
+package hookbot
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Statistics exported by ServeMetrics, in addition to the counters on
+// Hookbot which are also logged by ShowStatus.
+type metrics struct {
+	publishLatency *histogram // Seconds spent in Publish.
+	fanout         *histogram // Number of listeners per published message.
+
+	// Modified using atomic.AddInt64().
+	wsWriteErrors, bytesIn, bytesOut int64
+	keyGenerations                   []int64 // Tokens accepted per key.
+
+	mu      sync.Mutex
+	routers map[string]*routerMetrics // By router name.
+}
+
+type routerMetrics struct {
+	routed, failed int64 // Modified using atomic.AddInt64().
+}
+
+func newMetrics(nKeys int) *metrics {
+	return &metrics{
+		keyGenerations: make([]int64, nKeys),
+		publishLatency: newHistogram(
+			.0001, .0005, .001, .005, .01, .05, .1, .5, 1),
+		fanout:  newHistogram(0, 1, 2, 5, 10, 50, 100, 500, 1000),
+		routers: map[string]*routerMetrics{},
+	}
+}
+
+func (m *metrics) router(name string) *routerMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.routers[name]
+	if !ok {
+		r = &routerMetrics{}
+		m.routers[name] = r
+	}
+	return r
+}
+
+// A histogram with fixed bucket upper bounds, in the Prometheus style.
+type histogram struct {
+	mu      sync.Mutex
+	bounds  []float64
+	buckets []uint64 // Not cumulative; bucket i counts values <= bounds[i].
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, buckets: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	i := sort.SearchFloat64s(h.bounds, v)
+	if i < len(h.buckets) {
+		h.buckets[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) write(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.buckets[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+func writeMetric(w io.Writer, name, kind, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n",
+		name, help, name, kind, name, value)
+}
+
+// Escape a label value for the Prometheus text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// ServeMetrics writes statistics in the Prometheus text exposition format.
+func (h *Hookbot) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+
+	counters := []struct {
+		name, kind, help string
+		value            *int64
+	}{
+		{"hookbot_listeners", "gauge", "Number of connected listeners.", &h.listeners},
+		{"hookbot_published_total", "counter", "Messages accepted for delivery.", &h.publish},
+		{"hookbot_publish_dropped_total", "counter", "Messages dropped on publish because the server was busy.", &h.dropP},
+		{"hookbot_sends_total", "counter", "Messages handed to listeners.", &h.sends},
+		{"hookbot_send_dropped_total", "counter", "Messages dropped because a listener was too slow.", &h.dropS},
+		{"hookbot_unsafe_rejected_total", "counter", "Unsafe publishes rejected by an address allowlist.", &h.rejectU},
+		{"hookbot_websocket_write_errors_total", "counter", "Errors writing to subscriber websockets.", &h.metrics.wsWriteErrors},
+		{"hookbot_received_bytes_total", "counter", "Bytes of message bodies received from publishers.", &h.metrics.bytesIn},
+		{"hookbot_sent_bytes_total", "counter", "Bytes sent to subscribers.", &h.metrics.bytesOut},
+	}
+	for _, c := range counters {
+		writeMetric(&buf, c.name, c.kind, c.help, atomic.LoadInt64(c.value))
+	}
+
+	h.metrics.publishLatency.write(&buf, "hookbot_publish_duration_seconds",
+		"Time taken to publish a message.")
+	h.metrics.fanout.write(&buf, "hookbot_fanout_listeners",
+		"Number of listeners each published message is sent to.")
+
+	fmt.Fprintf(&buf, "# HELP hookbot_key_generation_matches_total Tokens accepted, by key generation (0 is the primary key).\n")
+	fmt.Fprintf(&buf, "# TYPE hookbot_key_generation_matches_total counter\n")
+	for generation := range h.metrics.keyGenerations {
+		fmt.Fprintf(&buf, "hookbot_key_generation_matches_total{generation=\"%d\"} %d\n",
+			generation, atomic.LoadInt64(&h.metrics.keyGenerations[generation]))
+	}
+
+	limiters := h.rateLimiters()
+	fmt.Fprintf(&buf, "# HELP hookbot_rate_limit_per_second Configured publish rate limits.\n")
+	fmt.Fprintf(&buf, "# TYPE hookbot_rate_limit_per_second gauge\n")
+	for _, l := range limiters {
+		fmt.Fprintf(&buf, "hookbot_rate_limit_per_second{%s} %g\n", l.labels(), l.limit.Rate)
+	}
+	fmt.Fprintf(&buf, "# HELP hookbot_rate_limit_burst Configured publish rate limit bursts.\n")
+	fmt.Fprintf(&buf, "# TYPE hookbot_rate_limit_burst gauge\n")
+	for _, l := range limiters {
+		fmt.Fprintf(&buf, "hookbot_rate_limit_burst{%s} %d\n", l.labels(), l.limit.Burst)
+	}
+	fmt.Fprintf(&buf, "# HELP hookbot_rate_limited_total Publishes rejected by a rate limit.\n")
+	fmt.Fprintf(&buf, "# TYPE hookbot_rate_limited_total counter\n")
+	for _, l := range limiters {
+		fmt.Fprintf(&buf, "hookbot_rate_limited_total{%s} %d\n",
+			l.labels(), atomic.LoadInt64(&l.rejected))
+	}
+
+	h.metrics.mu.Lock()
+	names := []string{}
+	for name := range h.metrics.routers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(&buf, "# HELP hookbot_router_routed_total Messages published by routers.\n")
+	fmt.Fprintf(&buf, "# TYPE hookbot_router_routed_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(&buf, "hookbot_router_routed_total{router=\"%s\"} %d\n",
+			labelEscaper.Replace(name),
+			atomic.LoadInt64(&h.metrics.routers[name].routed))
+	}
+	fmt.Fprintf(&buf, "# HELP hookbot_router_failed_total Messages routers failed to publish.\n")
+	fmt.Fprintf(&buf, "# TYPE hookbot_router_failed_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(&buf, "hookbot_router_failed_total{router=\"%s\"} %d\n",
+			labelEscaper.Replace(name),
+			atomic.LoadInt64(&h.metrics.routers[name].failed))
+	}
+	h.metrics.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// MetricsHandler serves ServeMetrics. If token is not empty, it must be given
+// as a bearer token or basic auth username.
+func (h *Hookbot) MetricsHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			given, _, ok := r.BasicAuth()
+			if !ok {
+				given = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			}
+			if !SecureEqual(given, token) {
+				w.Header().Add("WWW-Authenticate", `Basic realm="hookbot"`)
+				http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		h.ServeMetrics(w, r)
+	})
+}
@@ -0,0 +1,42 @@
+package hookbot
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Metrics are exposed in the Prometheus text format, behind the token.
+func TestMetrics(t *testing.T) {
+	hookbot := New(TEST_KEY)
+	defer hookbot.Shutdown()
+
+	hookbot.ServeHTTP(MakeRequest("POST", "/unsafe/pub/foo", "MESSAGE"))
+
+	handler := hookbot.MetricsHandler("t0ken")
+
+	w, r := MakeRequest("GET", "/metrics", "")
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Status code != 401 (= %v)", w.Code)
+	}
+
+	w, r = MakeRequest("GET", "/metrics", "")
+	r.Header.Set("Authorization", "Bearer t0ken")
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status code != 200 (= %v)", w.Code)
+	}
+
+	body := w.Body.String()
+	for _, expected := range []string{
+		"\nhookbot_published_total 1\n",
+		"\nhookbot_received_bytes_total 7\n",
+		"\nhookbot_fanout_listeners_bucket{le=\"0\"} 1\n",
+		"\nhookbot_publish_duration_seconds_count 1\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Metrics missing %q:\n%s", expected, body)
+		}
+	}
+}
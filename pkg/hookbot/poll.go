@@ -0,0 +1,113 @@
+package hookbot
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// How long a poll waits for a message, unless the client asks otherwise.
+	defaultPollTimeout = 25 * time.Second
+	maxPollTimeout     = 5 * time.Minute
+)
+
+// PollResponse is the body returned by ServePoll. Cursor should be passed as
+// ?since= on the next poll.
+type PollResponse struct {
+	Messages []Envelope `json:"messages"`
+	Cursor   uint64     `json:"cursor"`
+}
+
+// Subscribe to messages by HTTP long-polling.
+// A GET to /poll/<topic>?since=<cursor> returns immediately with any messages
+// in the history after `cursor`. Otherwise it waits until a message is
+// published, or until ?timeout= seconds pass, in which case the batch is empty.
+// Without history, messages published between polls are missed.
+func (h *Hookbot) ServePoll(w http.ResponseWriter, r *http.Request) {
+	topic := Topic(r)
+
+	since, haveSince, err := Since(r)
+	if err != nil {
+		http.Error(w, "400 Bad Request ("+err.Error()+")",
+			http.StatusBadRequest)
+		return
+	}
+	if !haveSince {
+		// Only interested in messages from now on.
+		since = math.MaxUint64
+	}
+
+	timeout := defaultPollTimeout
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		seconds, err := strconv.ParseUint(t, 10, 32)
+		if err != nil {
+			http.Error(w, "400 Bad Request (bad ?timeout=)",
+				http.StatusBadRequest)
+			return
+		}
+		timeout = time.Duration(seconds) * time.Second
+		if timeout > maxPollTimeout {
+			timeout = maxPollTimeout
+		}
+	}
+
+	replay := &replayRequest{since: since}
+	listener := h.add(topic, replay)
+	defer h.Del(listener)
+
+	// Everything up to replay.seq which is in the history is in the replay,
+	// so that is where the next poll should continue from.
+	response := PollResponse{Messages: []Envelope{}, Cursor: replay.seq}
+	if haveSince && since > response.Cursor {
+		response.Cursor = since
+	}
+
+	for _, m := range replay.messages {
+		response.Messages = append(response.Messages, NewEnvelope(m))
+	}
+
+	if len(response.Messages) == 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case m := <-listener.c:
+			response.Messages = append(response.Messages, NewEnvelope(m))
+			response.Cursor = m.Seq
+
+			// Include anything else which is immediately available.
+			for more := true; more; {
+				select {
+				case m := <-listener.c:
+					response.Messages = append(response.Messages, NewEnvelope(m))
+					response.Cursor = m.Seq
+				default:
+					more = false
+				}
+			}
+		case <-timer.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("Error in ServePoll marshalling response: %v", err)
+		http.Error(w, "500 Internal Server Error",
+			http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	n, err := w.Write(append(body, '\n'))
+	atomic.AddInt64(&h.metrics.bytesOut, int64(n))
+	if err != nil && !IsConnectionClose(err) {
+		log.Printf("Error in ServePoll writing response: %v", err)
+	}
+}
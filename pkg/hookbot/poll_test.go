@@ -0,0 +1,63 @@
+package hookbot
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func poll(t *testing.T, hookbot *Hookbot, url string) PollResponse {
+	w, r := MakeRequest("GET", url, "")
+	r.SetBasicAuth(Sha1HMAC(TEST_KEY, "/sub/foo/"), "")
+	hookbot.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status code != 200 (= %v)", w.Code)
+	}
+
+	var response PollResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Error unmarshalling poll response: %v", err)
+	}
+	return response
+}
+
+// Polling with a cursor returns what has been published since, and a cursor
+// which picks up where it left off. Tokens for /sub/ are accepted.
+func TestPollCursor(t *testing.T) {
+	hookbot := NewWithConfig(TEST_KEY, Config{HistorySize: 10})
+	defer hookbot.Shutdown()
+
+	hookbot.Publish(Message{Topic: "foo/a", Body: []byte("1")})
+	hookbot.Publish(Message{Topic: "other", Body: []byte("2")})
+	hookbot.Publish(Message{Topic: "foo/b", Body: []byte("3")})
+
+	response := poll(t, hookbot, "/poll/foo/?since=0")
+	if len(response.Messages) != 2 || response.Cursor != 3 {
+		t.Fatalf("Unexpected response: %+v", response)
+	}
+	if string(response.Messages[1].Body) != "3" {
+		t.Errorf("Unexpected message: %+v", response.Messages[1])
+	}
+
+	hookbot.Publish(Message{Topic: "foo/c", Body: []byte("4")})
+
+	response = poll(t, hookbot, "/poll/foo/?since=3")
+	if len(response.Messages) != 1 || response.Cursor != 4 {
+		t.Fatalf("Unexpected response: %+v", response)
+	}
+}
+
+// With nothing to return, a poll times out with an empty batch and the
+// current cursor.
+func TestPollTimeout(t *testing.T) {
+	hookbot := New(TEST_KEY)
+	defer hookbot.Shutdown()
+
+	hookbot.Publish(Message{Topic: "other", Body: []byte("1")})
+
+	response := poll(t, hookbot, "/poll/foo/?timeout=0")
+	if len(response.Messages) != 0 || response.Cursor != 1 {
+		t.Errorf("Unexpected response: %+v", response)
+	}
+}
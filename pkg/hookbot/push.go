@@ -0,0 +1,173 @@
+package hookbot
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// PushSubscription delivers messages published on Topic to URL by HTTP POST,
+// for receivers which can't hold a connection open to hookbot.
+type PushSubscription struct {
+	Topic string // Recursive if it ends in "/", as for /sub/.
+	URL   string
+
+	// If set, each delivery carries an X-Hookbot-Signature header of the form
+	// "sha256=<hex HMAC-SHA256 of the body keyed with Secret>".
+	Secret string
+}
+
+// Delivery settings for push subscriptions. Variables so that tests can
+// shorten them.
+var (
+	pushTimeout     = 10 * time.Second // Per attempt.
+	pushMaxAttempts = 10
+	pushBackoff     = 1 * time.Second // Doubled after each failed attempt...
+	pushMaxBackoff  = 5 * time.Minute // ...up to this.
+)
+
+// Messages waiting for delivery to a slow receiver beyond this are dropped.
+const pushQueueSize = 100
+
+// Parse a push subscription of the form "topic=url".
+func ParsePushSubscription(s, secret string) (PushSubscription, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return PushSubscription{}, fmt.Errorf("push subscription %q is not of the form topic=url", s)
+	}
+	return PushSubscription{Topic: parts[0], URL: parts[1], Secret: secret}, nil
+}
+
+// Deliver messages for one push subscription until shutdown.
+func (h *Hookbot) AddPush(p PushSubscription) {
+	l := h.Add(p.Topic)
+	queue := make(chan Message, pushQueueSize)
+
+	// Cancelled on shutdown, to abandon deliveries in progress and those
+	// still queued, rather than waiting for each to time out.
+	ctx, cancel := context.WithCancel(context.Background())
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		defer close(queue)
+
+		for {
+			select {
+			case m := <-l.c:
+				select {
+				case queue <- m:
+				default:
+					log.Printf("Push to %v: queue full, dropping %v", p.URL, m.ID)
+				}
+			case <-h.shutdown:
+				cancel()
+				close(l.dead)
+				return
+			}
+		}
+	}()
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+
+		client := &http.Client{Timeout: pushTimeout}
+		for m := range queue {
+			if ctx.Err() != nil {
+				log.Printf("Push to %v: shutting down, dropping %d queued messages",
+					p.URL, 1+len(queue))
+				return
+			}
+			p.deliver(ctx, client, m)
+		}
+	}()
+}
+
+// Sign body with the subscription's secret, in the form used for the
+// X-Hookbot-Signature header.
+func (p PushSubscription) Signature(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(p.Secret))
+	_, _ = mac.Write(body)
+	return fmt.Sprintf("sha256=%x", mac.Sum(nil))
+}
+
+// POST `m` to the subscriber, retrying with exponential backoff on failure.
+// Gives up early if `ctx` is cancelled.
+func (p PushSubscription) deliver(ctx context.Context, client *http.Client, m Message) {
+	backoff := pushBackoff
+
+	for attempt := 1; attempt <= pushMaxAttempts; attempt++ {
+		if ctx.Err() != nil {
+			return
+		}
+		retry, err := p.attempt(ctx, client, m)
+		if err == nil {
+			return
+		}
+		if !retry {
+			log.Printf("Push %v to %v failed permanently: %v", m.ID, p.URL, err)
+			return
+		}
+		log.Printf("Push %v to %v failed (attempt %d): %v",
+			m.ID, p.URL, attempt, err)
+
+		if attempt == pushMaxAttempts {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > pushMaxBackoff {
+			backoff = pushMaxBackoff
+		}
+	}
+
+	log.Printf("Push %v to %v: giving up after %d attempts",
+		m.ID, p.URL, pushMaxAttempts)
+}
+
+// Make one delivery attempt. retry is false if the error is not worth
+// retrying.
+func (p PushSubscription) attempt(ctx context.Context, client *http.Client, m Message) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", p.URL, bytes.NewReader(m.Body))
+	if err != nil {
+		return false, err
+	}
+
+	if m.ContentType != "" {
+		req.Header.Set("Content-Type", m.ContentType)
+	}
+	req.Header.Set("X-Hookbot-Topic", m.Topic)
+	req.Header.Set("X-Hookbot-Id", m.ID)
+	req.Header.Set("X-Hookbot-Timestamp", m.Time.Format(time.RFC3339Nano))
+	if p.Secret != "" {
+		req.Header.Set("X-Hookbot-Signature", p.Signature(m.Body))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500,
+		resp.StatusCode == http.StatusRequestTimeout,
+		resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("response: %v", resp.Status)
+	default:
+		return false, fmt.Errorf("response: %v", resp.Status)
+	}
+}
@@ -0,0 +1,99 @@
+package hookbot
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Push subscriptions retry failed deliveries and sign the body.
+func TestPushRetry(t *testing.T) {
+	defer func(b time.Duration) { pushBackoff = b }(pushBackoff)
+	pushBackoff = time.Millisecond
+
+	var attempts int32
+	type delivery struct {
+		header http.Header
+		body   string
+	}
+	delivered := make(chan delivery, 1)
+
+	receiver := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&attempts, 1) == 1 {
+				http.Error(w, "try again", http.StatusServiceUnavailable)
+				return
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			delivered <- delivery{r.Header, string(body)}
+		}))
+	defer receiver.Close()
+
+	hookbot := New(TEST_KEY)
+	defer hookbot.Shutdown()
+
+	p := PushSubscription{Topic: "foo/", URL: receiver.URL, Secret: "s3cret"}
+	hookbot.AddPush(p)
+
+	hookbot.Publish(Message{Topic: "foo/bar", Body: []byte("MESSAGE")})
+
+	select {
+	case d := <-delivered:
+		if d.body != "MESSAGE" {
+			t.Errorf("Unexpected body: %q", d.body)
+		}
+		if d.header.Get("X-Hookbot-Topic") != "foo/bar" {
+			t.Errorf("Unexpected topic: %q", d.header.Get("X-Hookbot-Topic"))
+		}
+		expected := p.Signature([]byte("MESSAGE"))
+		if d.header.Get("X-Hookbot-Signature") != expected {
+			t.Errorf("Signature != %q (= %q)",
+				expected, d.header.Get("X-Hookbot-Signature"))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Message not delivered")
+	}
+
+	if n := atomic.LoadInt32(&attempts); n != 2 {
+		t.Errorf("Expected 2 attempts, got %d", n)
+	}
+}
+
+// Shutdown abandons deliveries to a receiver which doesn't respond, rather
+// than waiting for each queued message to time out.
+func TestPushShutdown(t *testing.T) {
+	stop := make(chan struct{})
+	received := make(chan struct{}, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			received <- struct{}{}
+			select {
+			case <-r.Context().Done():
+			case <-stop:
+			}
+		}))
+	defer receiver.Close()
+	defer close(stop)
+
+	hookbot := New(TEST_KEY)
+	hookbot.AddPush(PushSubscription{Topic: "foo", URL: receiver.URL})
+
+	for i := 0; i < 10; i++ {
+		hookbot.Publish(Message{Topic: "foo", Body: []byte("MESSAGE")})
+	}
+	<-received // The rest are queued behind the first delivery.
+
+	done := make(chan struct{})
+	go func() {
+		hookbot.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(pushTimeout / 2):
+		t.Fatalf("Shutdown waited for deliveries")
+	}
+}
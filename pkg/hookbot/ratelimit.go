@@ -0,0 +1,222 @@
+package hookbot
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A RateLimit allows Rate publishes per second on average, in bursts of up to
+// Burst.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l RateLimit) String() string {
+	return fmt.Sprintf("%g/s burst %d", l.Rate, l.Burst)
+}
+
+// TopicRateLimit applies a RateLimit to publishes to topics under Prefix, all
+// of which share one bucket. A Prefix not ending in "/" is a single topic.
+type TopicRateLimit struct {
+	Prefix string
+	RateLimit
+}
+
+// ParseRateLimit parses a limit of the form "rate[:burst]", where rate is per
+// second. burst defaults to rate, rounded up.
+func ParseRateLimit(s string) (RateLimit, error) {
+	rate, burst, hasBurst := strings.Cut(s, ":")
+
+	var l RateLimit
+	var err error
+	l.Rate, err = strconv.ParseFloat(rate, 64)
+	if err != nil || l.Rate <= 0 {
+		return RateLimit{}, fmt.Errorf("rate limit %q: rate must be a positive number", s)
+	}
+
+	l.Burst = int(math.Ceil(l.Rate))
+	if hasBurst {
+		l.Burst, err = strconv.Atoi(burst)
+		if err != nil || l.Burst < 1 {
+			return RateLimit{}, fmt.Errorf("rate limit %q: burst must be a positive integer", s)
+		}
+	}
+	return l, nil
+}
+
+// ParseTopicRateLimit parses a limit of the form "prefix=rate[:burst]".
+func ParseTopicRateLimit(s string) (TopicRateLimit, error) {
+	prefix, limit, ok := strings.Cut(s, "=")
+	if !ok || prefix == "" {
+		return TopicRateLimit{}, fmt.Errorf("rate limit %q is not of the form prefix=rate[:burst]", s)
+	}
+	l, err := ParseRateLimit(limit)
+	if err != nil {
+		return TopicRateLimit{}, err
+	}
+	return TopicRateLimit{Prefix: prefix, RateLimit: l}, nil
+}
+
+// Buckets beyond this trigger a sweep of idle ones. If that doesn't free
+// any, the least recently used bucket is evicted.
+const maxBuckets = 10000
+
+// A set of token buckets sharing one limit, by key.
+type rateLimiter struct {
+	prefix string // Topic prefix, or empty for the per-client limit.
+	limit  RateLimit
+
+	rejected int64 // Modified using atomic.AddInt64().
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(prefix string, limit RateLimit) *rateLimiter {
+	return &rateLimiter{prefix: prefix, limit: limit, buckets: map[string]*bucket{}}
+}
+
+// Describe the limiter for status and metrics.
+func (l *rateLimiter) labels() string {
+	if l.prefix == "" {
+		return `scope="client"`
+	}
+	return fmt.Sprintf(`scope="topic",prefix="%s"`, labelEscaper.Replace(l.prefix))
+}
+
+// Take a token from the bucket for key. If there isn't one, returns false and
+// how long until there will be.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	burst := float64(l.limit.Burst)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.sweep(now)
+		}
+		if len(l.buckets) >= maxBuckets {
+			l.evictOldest()
+		}
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		atomic.AddInt64(&l.rejected, 1)
+		wait := (1 - b.tokens) / l.limit.Rate
+		return false, time.Duration(wait * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Forget buckets which would have refilled, since they are equivalent to new
+// ones. Called with mu held.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate >= float64(l.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Forget the bucket which was used least recently. Called with mu held.
+func (l *rateLimiter) evictOldest() {
+	var oldestKey string
+	var oldest *bucket
+	for key, b := range l.buckets {
+		if oldest == nil || b.last.Before(oldest.last) {
+			oldestKey, oldest = key, b
+		}
+	}
+	delete(l.buckets, oldestKey)
+}
+
+// The limiter for `topic`, the one with the longest matching prefix, or nil.
+func (h *Hookbot) topicLimiterFor(topic string) *rateLimiter {
+	var found *rateLimiter
+	for _, l := range h.topicLimiters {
+		if !TopicAllowed([]string{l.prefix}, topic) {
+			continue
+		}
+		if found == nil || len(l.prefix) > len(found.prefix) {
+			found = l
+		}
+	}
+	return found
+}
+
+// Identify the client making `r` for rate limiting: by its token if KeyChecker
+// verified one, otherwise by its address. Unverified tokens are ignored, since
+// a client could give a new one with each request.
+func (h *Hookbot) clientKey(r *http.Request) string {
+	if token, ok := verifiedToken(r); ok {
+		return "token " + TokenHash(token)
+	}
+	return "ip " + ClientIP(r, h.trustedProxies).String()
+}
+
+// RateLimited responds with 429 Too Many Requests to publishes which exceed
+// the rate limit for their topic or client.
+func (h *Hookbot) RateLimited(wrapped http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+
+		// The client's own limit is checked first, so that a flooding client
+		// doesn't use up the topic's allowance.
+		if h.clientLimiter != nil {
+			ok, wait := h.clientLimiter.allow(h.clientKey(r), now)
+			if !ok {
+				tooManyRequests(w, wait)
+				return
+			}
+		}
+
+		topic := strings.TrimPrefix(Topic(r), "/unsafe/")
+		if l := h.topicLimiterFor(topic); l != nil {
+			ok, wait := l.allow(l.prefix, now)
+			if !ok {
+				tooManyRequests(w, wait)
+				return
+			}
+		}
+
+		wrapped.ServeHTTP(w, r)
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "429 Too Many Requests", http.StatusTooManyRequests)
+}
+
+// All configured limiters, topics first.
+func (h *Hookbot) rateLimiters() []*rateLimiter {
+	limiters := append([]*rateLimiter{}, h.topicLimiters...)
+	if h.clientLimiter != nil {
+		limiters = append(limiters, h.clientLimiter)
+	}
+	return limiters
+}
@@ -0,0 +1,137 @@
+package hookbot
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want RateLimit
+	}{
+		{"10", RateLimit{10, 10}},
+		{"0.5", RateLimit{0.5, 1}},
+		{"2:20", RateLimit{2, 20}},
+	} {
+		got, err := ParseRateLimit(tc.in)
+		if err != nil || got != tc.want {
+			t.Errorf("ParseRateLimit(%q) = %v, %v, want %v", tc.in, got, err, tc.want)
+		}
+	}
+
+	for _, in := range []string{"", "0", "-1", "x", "1:0", "1:x"} {
+		if _, err := ParseRateLimit(in); err == nil {
+			t.Errorf("ParseRateLimit(%q) succeeded", in)
+		}
+	}
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	l := newRateLimiter("foo/", RateLimit{Rate: 2, Burst: 2})
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("k", now); !ok {
+			t.Fatalf("Request %d within burst rejected", i)
+		}
+	}
+	ok, wait := l.allow("k", now)
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("Request beyond burst: ok = %v, wait = %v", ok, wait)
+	}
+	if ok, _ := l.allow("other", now); !ok {
+		t.Errorf("Other key rejected")
+	}
+	if ok, _ := l.allow("k", now.Add(wait)); !ok {
+		t.Errorf("Request after waiting rejected")
+	}
+}
+
+// Publishing beyond a topic's limit gets 429 with Retry-After. Other topics
+// are unaffected.
+func TestRateLimitedPublish(t *testing.T) {
+	hookbot := NewWithConfig(TEST_KEY, Config{
+		TopicRateLimits: []TopicRateLimit{
+			{Prefix: "noisy/", RateLimit: RateLimit{Rate: 0.1, Burst: 1}},
+		},
+	})
+	defer hookbot.Shutdown()
+
+	publish := func(target string) *http.Response {
+		w, r := MakeRequest("POST", target, "MESSAGE")
+		hookbot.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	if resp := publish("/unsafe/pub/noisy/a"); resp.StatusCode != http.StatusOK {
+		t.Errorf("First publish: status code != 200 (= %v)", resp.StatusCode)
+	}
+	resp := publish("/unsafe/pub/noisy/b")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Second publish: status code != 429 (= %v)", resp.StatusCode)
+	}
+	if ra := resp.Header.Get("Retry-After"); ra != "10" {
+		t.Errorf("Retry-After != 10 (= %q)", ra)
+	}
+	if resp := publish("/unsafe/pub/quiet"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Other topic: status code != 200 (= %v)", resp.StatusCode)
+	}
+
+	w, r := MakeRequest("GET", "/metrics", "")
+	hookbot.ServeMetrics(w, r)
+	expected := "\nhookbot_rate_limited_total{scope=\"topic\",prefix=\"noisy/\"} 1\n"
+	if !strings.Contains(w.Body.String(), expected) {
+		t.Errorf("Metrics missing %q:\n%s", expected, w.Body.String())
+	}
+}
+
+// Clients are limited by their token only once it has been verified, so
+// unsafe publishes can't dodge the limit by giving a new token each time.
+func TestClientRateLimit(t *testing.T) {
+	hookbot := NewWithConfig(TEST_KEY, Config{
+		ClientRateLimit: RateLimit{Rate: 0.1, Burst: 1},
+	})
+	defer hookbot.Shutdown()
+
+	publish := func(target, token string) int {
+		w, r := MakeRequest("POST", target, "MESSAGE")
+		r.Header.Set("Authorization", "Bearer "+token)
+		hookbot.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for i, test := range []struct {
+		target, token string
+		expected      int
+	}{
+		{"/unsafe/pub/place", "made-up-1", http.StatusOK},
+		{"/unsafe/pub/place", "made-up-2", http.StatusTooManyRequests},
+		{"/pub/place", Sha1HMAC(TEST_KEY, "/pub/place"), http.StatusOK},
+		{"/pub/place", Sha1HMAC(TEST_KEY, "/pub/place"), http.StatusTooManyRequests},
+		{"/pub/other", Sha1HMAC(TEST_KEY, "/pub/other"), http.StatusOK},
+	} {
+		if code := publish(test.target, test.token); code != test.expected {
+			t.Errorf("Publish %d: status code != %v (= %v)", i, test.expected, code)
+		}
+	}
+}
+
+// The number of buckets is bounded even when none of them are idle.
+func TestRateLimiterBucketCap(t *testing.T) {
+	l := newRateLimiter("", RateLimit{Rate: 1, Burst: 1})
+	now := time.Now()
+
+	for i := 0; i < maxBuckets+10; i++ {
+		l.allow(strconv.Itoa(i), now.Add(time.Duration(i)))
+	}
+	if n := len(l.buckets); n > maxBuckets {
+		t.Errorf("%d buckets, more than %d", n, maxBuckets)
+	}
+	if _, ok := l.buckets["0"]; ok {
+		t.Errorf("Least recently used bucket wasn't evicted")
+	}
+}
@@ -0,0 +1,116 @@
+package hookbot
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// RevocationList is a set of tokens which must no longer be accepted. Tokens
+// are identified by the hex encoded SHA-256 of the token, so that the list
+// itself doesn't grant access to anything. It is safe for concurrent use.
+type RevocationList struct {
+	path string
+
+	mu     sync.RWMutex
+	hashes map[string]struct{}
+}
+
+// TokenHash returns the form in which `token` appears in a RevocationList.
+func TokenHash(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
+// LoadRevocationList reads a list of token hashes from `path`, one per line.
+// Blank lines and anything following a "#" are ignored.
+func LoadRevocationList(path string) (*RevocationList, error) {
+	l := &RevocationList{path: path}
+	return l, l.Reload()
+}
+
+// Reload re-reads the list from its file. On error, the previous list is kept.
+func (l *RevocationList) Reload() error {
+	fd, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	hashes := map[string]struct{}{}
+	scanner := bufio.NewScanner(fd)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.ToLower(strings.TrimSpace(line))
+		if line == "" {
+			continue
+		}
+		if len(line) != sha256.Size*2 {
+			return fmt.Errorf("%s:%d: not a SHA-256 hash: %q", l.path, n, line)
+		}
+		hashes[line] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hashes = hashes
+	return nil
+}
+
+func (l *RevocationList) IsRevoked(token string) bool {
+	if l == nil {
+		return false
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	_, revoked := l.hashes[TokenHash(token)]
+	return revoked
+}
+
+func (l *RevocationList) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.hashes)
+}
+
+// ReloadRevocations re-reads the revocation list, if there is one.
+func (h *Hookbot) ReloadRevocations() error {
+	if h.revocations == nil {
+		return nil
+	}
+	err := h.revocations.Reload()
+	if err != nil {
+		return err
+	}
+	log.Printf("Loaded %d revoked tokens", h.revocations.Len())
+	return nil
+}
+
+// Reload the revocation list via HTTP POST.
+func (h *Hookbot) ServeReloadRevocations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := h.ReloadRevocations()
+	if err != nil {
+		log.Printf("Error reloading revocation list: %v", err)
+		http.Error(w, "500 Internal Server Error",
+			http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
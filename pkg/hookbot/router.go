@@ -12,6 +12,12 @@ type Router interface {
 	Route(in Message, publish func(Message) bool)
 }
 
+// Routers which need settings from the command line implement Configurable.
+// Configure is called before the router is added.
+type Configurable interface {
+	Configure(c *cli.Context) error
+}
+
 var availableRouters []Router
 
 func RegisterRouter(router Router) {
@@ -31,6 +37,13 @@ func ConfigureRouters(c *cli.Context, h *Hookbot) {
 			continue
 		}
 
+		if configurable, ok := router.(Configurable); ok {
+			err := configurable.Configure(c)
+			if err != nil {
+				log.Fatalf("Unable to configure router %q: %v", router.Name(), err)
+			}
+		}
+
 		log.Printf("Add router %q", router.Name())
 
 		h.AddRouter(router)
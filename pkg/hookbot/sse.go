@@ -0,0 +1,153 @@
+package hookbot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// How often a comment is sent on an idle event stream, so that proxies don't
+// consider the connection dead.
+const eventStreamKeepalive = 30 * time.Second
+
+// WantsEventStream returns true if the client asked for Server-Sent Events.
+func WantsEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// EventStreamOr serves ServeEventStream to clients which accept
+// text/event-stream, and `wrapped` to everyone else.
+func (h *Hookbot) EventStreamOr(wrapped http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if WantsEventStream(r) {
+			h.ServeEventStream(w, r)
+			return
+		}
+		wrapped.ServeHTTP(w, r)
+	}
+}
+
+// Subscribe to messages as Server-Sent Events.
+// Each event has the topic as its type and the message ID as its ID. If the
+// client reconnects with a Last-Event-ID which is still in the history, the
+// messages it missed are sent first. ?since= is also understood, as for
+// ServeSubscribe.
+func (h *Hookbot) ServeEventStream(w http.ResponseWriter, r *http.Request) {
+	topic := Topic(r)
+
+	since, haveSince, err := Since(r)
+	if err != nil {
+		http.Error(w, "400 Bad Request ("+err.Error()+")",
+			http.StatusBadRequest)
+		return
+	}
+
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		seq, ok := h.history.SeqOf(id)
+		if ok {
+			since, haveSince = seq, true
+		} else {
+			log.Printf("Last-Event-ID %q not in history", id)
+		}
+	}
+
+	var (
+		listener Listener
+		replay   []Message
+	)
+	if haveSince {
+		listener, replay = h.AddSince(topic, since)
+	} else {
+		listener = h.Add(topic)
+	}
+	defer h.Del(listener)
+
+	envelope := WantsEnvelope(nil, r)
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	// Returns false if the connection should be abandoned.
+	flush := func(buf *bytes.Buffer) bool {
+		rc.SetWriteDeadline(time.Now().Add(90 * time.Second))
+		n, err := w.Write(buf.Bytes())
+		atomic.AddInt64(&h.metrics.bytesOut, int64(n))
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			if !IsConnectionClose(err) {
+				log.Printf("Error writing event stream: %v", err)
+			}
+			return false
+		}
+		return true
+	}
+
+	send := func(message Message) bool {
+		data := message.Body
+		if envelope {
+			var err error
+			data, err = json.Marshal(NewEnvelope(message))
+			if err != nil {
+				log.Printf("Error marshalling envelope: %v", err)
+				return false
+			}
+		}
+
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "id: %s\n", message.ID)
+		// Publish refuses topics with line breaks, but check anyway since
+		// one would let the publisher forge fields.
+		if ValidTopic(message.Topic) {
+			fmt.Fprintf(&buf, "event: %s\n", message.Topic)
+		}
+		// Line breaks (CR, LF or CRLF) delimit fields, so each line of the
+		// body is sent as a separate data field. The client joins them with
+		// "\n".
+		for _, line := range eventStreamLines.Split(string(data), -1) {
+			fmt.Fprintf(&buf, "data: %s\n", line)
+		}
+		buf.WriteString("\n")
+		return flush(&buf)
+	}
+
+	if !flush(&bytes.Buffer{}) {
+		return
+	}
+
+	for _, message := range replay {
+		if !send(message) {
+			return
+		}
+	}
+
+	keepalive := time.NewTicker(eventStreamKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case message := <-listener.c:
+			if !send(message) {
+				return
+			}
+		case <-keepalive.C:
+			if !flush(bytes.NewBufferString(": keepalive\n\n")) {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Line breaks, as the event stream format understands them.
+var eventStreamLines = regexp.MustCompile("\r\n|\r|\n")
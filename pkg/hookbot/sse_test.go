@@ -0,0 +1,98 @@
+package hookbot
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// An event stream subscriber reconnecting with Last-Event-ID receives the
+// messages it missed, with the topic as the event type.
+func TestEventStreamLastEventID(t *testing.T) {
+	hookbot := NewWithConfig(TEST_KEY, Config{HistorySize: 10})
+	defer hookbot.Shutdown()
+
+	server := httptest.NewServer(hookbot)
+	defer server.Close()
+
+	hookbot.Publish(Message{Topic: "foo/a", Body: []byte("first")})
+	hookbot.Publish(Message{Topic: "foo/b", Body: []byte("second\nline")})
+
+	l, replay := hookbot.AddSince("foo/a", 0)
+	hookbot.Del(l)
+	firstID := replay[0].ID
+
+	r, _ := http.NewRequest("GET", server.URL+"/sub/foo/", nil)
+	r.SetBasicAuth(Sha1HMAC(TEST_KEY, "/sub/foo/"), "")
+	r.Header.Set("Accept", "text/event-stream")
+	r.Header.Set("Last-Event-ID", firstID)
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type != text/event-stream (= %q)", ct)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	lines := []string{}
+	for scanner.Scan() && scanner.Text() != "" {
+		lines = append(lines, scanner.Text())
+	}
+
+	got := strings.Join(lines, "|")
+	if !strings.HasPrefix(got, "id: ") ||
+		!strings.HasSuffix(got, "|event: foo/b|data: second|data: line") {
+		t.Errorf("Unexpected event: %q", got)
+	}
+}
+
+// Line breaks in a topic or body can't be used to forge event stream fields.
+func TestEventStreamInjection(t *testing.T) {
+	hookbot := NewWithConfig(TEST_KEY, Config{HistorySize: 10})
+	defer hookbot.Shutdown()
+
+	w, r := MakeRequest("POST", "/unsafe/pub/foo%0Aid:%20forged", "MESSAGE")
+	hookbot.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Publish to topic with newline: status code != 400 (= %v)", w.Code)
+	}
+	if hookbot.Publish(Message{Topic: "foo\rid: forged"}) {
+		t.Errorf("Published message with carriage return in topic")
+	}
+
+	hookbot.Publish(Message{Topic: "foo", Body: []byte("a\rid: forged\r\nb")})
+
+	server := httptest.NewServer(hookbot)
+	defer server.Close()
+
+	r, _ = http.NewRequest("GET", server.URL+"/sub/foo?since=0", nil)
+	r.SetBasicAuth(Sha1HMAC(TEST_KEY, "/sub/foo"), "")
+	r.Header.Set("Accept", "text/event-stream")
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	lines := []string{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil || line == "\n" {
+			break
+		}
+		lines = append(lines, line)
+	}
+
+	got := strings.Join(lines, "")
+	if !strings.HasSuffix(got, "\nevent: foo\ndata: a\ndata: id: forged\ndata: b\n") {
+		t.Errorf("Unexpected event: %q", got)
+	}
+}
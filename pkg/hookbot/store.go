@@ -0,0 +1,477 @@
+package hookbot
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type StoreConfig struct {
+	Dir string
+
+	// The active segment is sealed and a new one started once it reaches
+	// SegmentSize bytes.
+	SegmentSize int64
+
+	// Sealed segments are deleted once every record in them is older than
+	// MaxAge, or while the log is larger than MaxSize. 0 means no limit.
+	MaxAge  time.Duration
+	MaxSize int64
+}
+
+const DefaultSegmentSize = 64 << 20
+
+// Store is a durable, append-only log of published messages, kept as a
+// directory of segment files. Each segment is named after the sequence number
+// of the first message it may contain and holds one JSON record per line.
+// It is safe for concurrent use.
+type Store struct {
+	config StoreConfig
+
+	// Held by Expire and Compact, which change which segments exist.
+	maintenance sync.Mutex
+
+	mu       sync.Mutex
+	segments []*segment // Oldest first. The last one is active.
+	active   *os.File
+	closed   bool
+}
+
+type segment struct {
+	path              string
+	firstSeq, lastSeq uint64 // lastSeq is 0 for an empty segment.
+	lastTime          time.Time
+	size              int64
+}
+
+// The on-disk representation of one message.
+type storeRecord struct {
+	Seq         uint64
+	ID          string
+	Time        time.Time
+	Topic       string
+	ContentType string `json:",omitempty"`
+	Body        []byte
+}
+
+const segmentSuffix = ".log"
+
+func segmentPath(dir string, firstSeq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", firstSeq, segmentSuffix))
+}
+
+// OpenStore opens (creating if necessary) the log in config.Dir.
+func OpenStore(config StoreConfig) (*Store, error) {
+	if config.SegmentSize <= 0 {
+		config.SegmentSize = DefaultSegmentSize
+	}
+
+	err := os.MkdirAll(config.Dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(config.Dir, "*"+segmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths) // Zero-padded names sort by sequence number.
+
+	s := &Store{config: config}
+
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), segmentSuffix)
+		firstSeq, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			log.Printf("Store: ignoring unexpected file %q", path)
+			continue
+		}
+
+		seg := &segment{path: path, firstSeq: firstSeq}
+		seg.size, err = seg.scan(math.MaxInt64, func(r storeRecord) {
+			seg.lastSeq, seg.lastTime = r.Seq, r.Time
+		})
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, seg)
+	}
+
+	if len(s.segments) == 0 {
+		err = s.roll(1)
+	} else {
+		// Drop any truncated record so that appends start on a new line.
+		last := s.segments[len(s.segments)-1]
+		err = os.Truncate(last.path, last.size)
+		if err == nil {
+			s.active, err = os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0600)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Read the records in the first `limit` bytes of the segment, calling fn for
+// each, and return the size of those records. A truncated final record (for
+// example, from a crash part way through a write) is skipped, as are corrupt
+// records, so that one bad write can't stop the server from starting.
+func (seg *segment) scan(limit int64, fn func(storeRecord)) (int64, error) {
+	fd, err := os.Open(seg.path)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+
+	var size int64
+	r := bufio.NewReader(io.LimitReader(fd, limit))
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("Store: skipping truncated record in %q", seg.path)
+			}
+			return size, nil
+		}
+		if err != nil {
+			return size, err
+		}
+		size += int64(len(line))
+
+		var record storeRecord
+		err = json.Unmarshal(line, &record)
+		if err != nil {
+			log.Printf("Store: skipping corrupt record in %q: %v", seg.path, err)
+			continue
+		}
+		fn(record)
+	}
+}
+
+// Start a new active segment whose first sequence number will be firstSeq.
+// Must be called with s.mu held.
+func (s *Store) roll(firstSeq uint64) error {
+	if s.active != nil {
+		err := s.active.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	path := segmentPath(s.config.Dir, firstSeq)
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	s.active = fd
+	s.segments = append(s.segments, &segment{path: path, firstSeq: firstSeq})
+	return nil
+}
+
+// LastSeq returns the highest sequence number ever written to the store.
+func (s *Store) LastSeq() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var last uint64
+	for _, seg := range s.segments {
+		if seg.lastSeq > last {
+			last = seg.lastSeq
+		}
+		if seg.firstSeq > 0 && seg.firstSeq-1 > last {
+			// All records before this segment may have been removed.
+			last = seg.firstSeq - 1
+		}
+	}
+	return last
+}
+
+// Append `m` to the log. m.Seq must be greater than any previously appended.
+func (s *Store) Append(m Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	line, err := json.Marshal(storeRecord{
+		Seq:         m.Seq,
+		ID:          m.ID,
+		Time:        m.Time,
+		Topic:       m.Topic,
+		ContentType: m.ContentType,
+		Body:        m.Body,
+	})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if s.closed {
+		return errors.New("store is closed")
+	}
+
+	seg := s.segments[len(s.segments)-1]
+	if seg.size > 0 && seg.size+int64(len(line)) > s.config.SegmentSize {
+		err = s.roll(m.Seq)
+		if err != nil {
+			return err
+		}
+		seg = s.segments[len(s.segments)-1]
+	}
+
+	_, err = s.active.Write(line)
+	if err != nil {
+		// Remove any part of the record which was written (for example, if
+		// the disk is full), so that the next one starts on a new line.
+		// Failing that, the part is left at the end of a sealed segment.
+		if truncErr := s.active.Truncate(seg.size); truncErr != nil {
+			log.Printf("Store: truncating %q: %v", seg.path, truncErr)
+			if rollErr := s.roll(m.Seq + 1); rollErr != nil {
+				log.Printf("Store: rolling past %q: %v", seg.path, rollErr)
+			}
+		}
+		return err
+	}
+	seg.size += int64(len(line))
+	seg.lastSeq, seg.lastTime = m.Seq, m.Time
+	return nil
+}
+
+// Replay calls fn with every message in the log, oldest first.
+func (s *Store) Replay(fn func(Message)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, seg := range s.segments {
+		_, err := seg.scan(seg.size, func(r storeRecord) {
+			fn(Message{
+				Topic:       r.Topic,
+				Body:        r.Body,
+				ContentType: r.ContentType,
+				Seq:         r.Seq,
+				ID:          r.ID,
+				Time:        r.Time,
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Expire deletes sealed segments which fall outside of the configured
+// retention by age or by size. The active segment is never deleted.
+func (s *Store) Expire(now time.Time) error {
+	s.maintenance.Lock()
+	defer s.maintenance.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+
+	for len(s.segments) > 1 {
+		oldest := s.segments[0]
+
+		tooOld := s.config.MaxAge > 0 &&
+			now.Sub(oldest.lastTime) > s.config.MaxAge
+		tooBig := s.config.MaxSize > 0 && total > s.config.MaxSize
+
+		if !tooOld && !tooBig {
+			break
+		}
+
+		err := os.Remove(oldest.path)
+		if err != nil {
+			return err
+		}
+		total -= oldest.size
+		s.segments = s.segments[1:]
+	}
+	return nil
+}
+
+// Compact rewrites the sealed segments so that they only contain records
+// which are among the `keep` most recent for their topic, across the whole
+// log. Those are the only records needed to rebuild the history on startup.
+// Segments left empty are deleted. If keep <= 0 there is no history to
+// rebuild, so the log is left to Expire and nothing is compacted.
+//
+// Sealed segments never change and the active one is only appended to, so
+// they are read and rewritten without holding s.mu, which would hold up
+// Append. It is only taken to read the segment list and to swap in the
+// rewritten segments.
+func (s *Store) Compact(keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+
+	s.maintenance.Lock()
+	defer s.maintenance.Unlock()
+
+	s.mu.Lock()
+	segments := append([]*segment{}, s.segments...)
+	sizes := make([]int64, len(segments))
+	for i, seg := range segments {
+		sizes[i] = seg.size
+	}
+	s.mu.Unlock()
+
+	sealed := segments[:len(segments)-1]
+
+	// Find the sequence numbers of the records worth keeping, counting the
+	// records in each sealed segment.
+	perTopic := map[string][]uint64{}
+	records := make([]int, len(sealed))
+	for i, seg := range segments {
+		_, err := seg.scan(sizes[i], func(r storeRecord) {
+			if i < len(sealed) {
+				records[i]++
+			}
+			seqs := append(perTopic[r.Topic], r.Seq)
+			if len(seqs) > keep {
+				seqs = seqs[1:]
+			}
+			perTopic[r.Topic] = seqs
+		})
+		if err != nil {
+			return err
+		}
+	}
+	wanted := map[uint64]struct{}{}
+	kept := make([]int, len(sealed))
+	for _, seqs := range perTopic {
+		for _, seq := range seqs {
+			wanted[seq] = struct{}{}
+
+			// The segment holding seq is the last starting at or before it.
+			i := sort.Search(len(segments), func(i int) bool {
+				return segments[i].firstSeq > seq
+			}) - 1
+			if i >= 0 && i < len(sealed) {
+				kept[i]++
+			}
+		}
+	}
+
+	// Rewrite the segments which have records to remove, leaving the results
+	// in temporary files. A nil replacement means the segment is removed.
+	replacements := map[*segment]*segment{}
+	defer func() {
+		for seg := range replacements {
+			os.Remove(seg.path + ".tmp") // No-op once renamed.
+		}
+	}()
+	for i, seg := range sealed {
+		if records[i] > 0 && kept[i] == records[i] {
+			continue
+		}
+		compacted, err := seg.compact(sizes[i], wanted)
+		replacements[seg] = compacted
+		if err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	remaining := []*segment{}
+	for _, seg := range s.segments {
+		compacted, ok := replacements[seg]
+		if !ok {
+			remaining = append(remaining, seg)
+			continue
+		}
+
+		var replaceErr error
+		if compacted == nil {
+			replaceErr = os.Remove(seg.path)
+		} else {
+			replaceErr = os.Rename(seg.path+".tmp", seg.path)
+		}
+		if replaceErr != nil {
+			if err == nil {
+				err = replaceErr
+			}
+			compacted = seg // Carry on with the original.
+		}
+		if compacted != nil {
+			remaining = append(remaining, compacted)
+		}
+	}
+	s.segments = remaining
+	return err
+}
+
+// Write the records in the first `size` bytes of the segment which are in
+// `wanted` to a temporary file alongside it, returning the segment which that
+// file will be once renamed. Returns nil if nothing in it is wanted.
+func (seg *segment) compact(size int64, wanted map[uint64]struct{}) (*segment, error) {
+	fd, err := os.OpenFile(seg.path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(fd)
+	out := &segment{path: seg.path, firstSeq: seg.firstSeq}
+
+	var encodeErr error
+	_, err = seg.scan(size, func(r storeRecord) {
+		if _, ok := wanted[r.Seq]; !ok || encodeErr != nil {
+			return
+		}
+		line, err := json.Marshal(r)
+		if err != nil {
+			encodeErr = err
+			return
+		}
+		line = append(line, '\n')
+		w.Write(line)
+		out.size += int64(len(line))
+		out.lastSeq, out.lastTime = r.Seq, r.Time
+	})
+	if err == nil {
+		err = encodeErr
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if out.size == 0 {
+		return nil, nil
+	}
+	return out, nil
+}
+
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.active.Close()
+}
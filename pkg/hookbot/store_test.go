@@ -0,0 +1,233 @@
+package hookbot
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T, config StoreConfig) *Store {
+	store, err := OpenStore(config)
+	if err != nil {
+		t.Fatalf("OpenStore: %v", err)
+	}
+	return store
+}
+
+// History and sequence numbers should survive a restart.
+func TestStoreRestart(t *testing.T) {
+	config := StoreConfig{Dir: t.TempDir()}
+
+	func() {
+		store := openTestStore(t, config)
+		hookbot := NewWithConfig(TEST_KEY, Config{HistorySize: 10, Store: store})
+		defer hookbot.Shutdown()
+
+		for i := 0; i < 3; i++ {
+			hookbot.Publish(Message{Topic: "t", Body: []byte(fmt.Sprint(i))})
+		}
+	}()
+
+	store := openTestStore(t, config)
+	hookbot := NewWithConfig(TEST_KEY, Config{HistorySize: 10, Store: store})
+	defer hookbot.Shutdown()
+
+	hookbot.Publish(Message{Topic: "t", Body: []byte("3")})
+
+	l, replay := hookbot.AddSince("t", 1)
+	defer hookbot.Del(l)
+
+	got := []string{}
+	for _, m := range replay {
+		got = append(got, fmt.Sprintf("%d:%s", m.Seq, m.Body))
+	}
+	if fmt.Sprint(got) != "[2:1 3:2 4:3]" {
+		t.Errorf("Unexpected replay after restart: %v", got)
+	}
+}
+
+// Sealed segments beyond the size limit are removed, compaction drops
+// superseded records, and neither loses the sequence number.
+func TestStoreRetention(t *testing.T) {
+	config := StoreConfig{Dir: t.TempDir(), SegmentSize: 1, MaxSize: 200}
+	store := openTestStore(t, config)
+	defer store.Close()
+
+	for seq := uint64(1); seq <= 10; seq++ {
+		topic := "a"
+		if seq%2 == 0 {
+			topic = "b"
+		}
+		err := store.Append(Message{Topic: topic, Body: []byte("x"), Seq: seq})
+		if err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+
+	segments := func() int {
+		paths, _ := filepath.Glob(filepath.Join(config.Dir, "*.log"))
+		return len(paths)
+	}
+	if n := segments(); n != 10 {
+		t.Fatalf("Expected one segment per record, got %d", n)
+	}
+
+	if err := store.Expire(time.Now()); err != nil {
+		t.Fatalf("Expire: %v", err)
+	}
+	if n := segments(); n >= 10 || n == 0 {
+		t.Errorf("Expected some segments to be removed, have %d", n)
+	}
+
+	if err := store.Compact(1); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+
+	seqs := []uint64{}
+	store.Replay(func(m Message) { seqs = append(seqs, m.Seq) })
+	if fmt.Sprint(seqs) != "[9 10]" {
+		t.Errorf("Unexpected records after compaction: %v", seqs)
+	}
+
+	if last := store.LastSeq(); last != 10 {
+		t.Errorf("LastSeq() != 10 (= %d)", last)
+	}
+}
+
+// Without history, compaction would have nothing to keep, so it leaves the
+// log to retention instead. Shutdown closes the store.
+func TestStoreWithoutHistory(t *testing.T) {
+	store := openTestStore(t, StoreConfig{Dir: t.TempDir(), SegmentSize: 1})
+	hookbot := NewWithConfig(TEST_KEY, Config{Store: store})
+
+	for i := 0; i < 3; i++ {
+		hookbot.Publish(Message{Topic: "t", Body: []byte(fmt.Sprint(i))})
+	}
+
+	if err := store.Compact(0); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+
+	seqs := []uint64{}
+	store.Replay(func(m Message) { seqs = append(seqs, m.Seq) })
+	if fmt.Sprint(seqs) != "[1 2 3]" {
+		t.Errorf("Unexpected records after compaction: %v", seqs)
+	}
+
+	hookbot.Shutdown()
+	if err := store.Append(Message{Topic: "t", Seq: 4}); err == nil {
+		t.Errorf("Append succeeded after Shutdown")
+	}
+}
+
+// Compaction doesn't hold up appends, which aren't lost by it, and segments
+// with nothing to remove aren't rewritten.
+func TestStoreCompactConcurrent(t *testing.T) {
+	config := StoreConfig{Dir: t.TempDir(), SegmentSize: 100}
+	store := openTestStore(t, config)
+	defer store.Close()
+
+	// The first segment only has one record per topic, so it is kept as is.
+	for seq := uint64(1); seq <= 2; seq++ {
+		topic := fmt.Sprint("only", seq)
+		if err := store.Append(Message{Topic: topic, Body: []byte("x"), Seq: seq}); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	first := filepath.Join(config.Dir, fmt.Sprintf("%020d.log", 1))
+	before, err := os.Stat(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for seq := uint64(3); seq <= 200; seq++ {
+			err := store.Append(Message{Topic: "t", Body: []byte("x"), Seq: seq})
+			if err != nil {
+				t.Errorf("Append: %v", err)
+			}
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		if err := store.Compact(1); err != nil {
+			t.Fatalf("Compact: %v", err)
+		}
+	}
+	<-done
+	if err := store.Compact(1); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+
+	seqs := []uint64{}
+	store.Replay(func(m Message) { seqs = append(seqs, m.Seq) })
+	if fmt.Sprint(seqs[:2]) != "[1 2]" || seqs[len(seqs)-1] != 200 {
+		t.Errorf("Unexpected records after compaction: %v", seqs)
+	}
+
+	after, err := os.Stat(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Errorf("Segment with nothing to remove was rewritten")
+	}
+}
+
+// A corrupt or partly written record doesn't stop the store from opening,
+// and a failed append doesn't break the ones after it.
+func TestStoreBadWrites(t *testing.T) {
+	config := StoreConfig{Dir: t.TempDir()}
+	store := openTestStore(t, config)
+
+	appendSeq := func(seq uint64) error {
+		return store.Append(Message{Topic: "t", Body: []byte("x"), Seq: seq})
+	}
+
+	if err := appendSeq(1); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	// Part of a record, as left by a crash or a full disk, then a record
+	// which is appended to the same line.
+	path := filepath.Join(config.Dir, fmt.Sprintf("%020d.log", 1))
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteString(`{"Seq":2,"Top`)
+	fd.Close()
+	if err := appendSeq(3); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	// A write which fails outright.
+	good := store.active
+	store.active, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := appendSeq(4); err == nil {
+		t.Errorf("Append to a read only file succeeded")
+	}
+	good.Close()
+	if err := appendSeq(5); err != nil {
+		t.Fatalf("Append after failure: %v", err)
+	}
+	store.Close()
+
+	store = openTestStore(t, config)
+	defer store.Close()
+
+	seqs := []uint64{}
+	store.Replay(func(m Message) { seqs = append(seqs, m.Seq) })
+	if fmt.Sprint(seqs) != "[1 5]" {
+		t.Errorf("Unexpected records after reopening: %v", seqs)
+	}
+	if last := store.LastSeq(); last != 5 {
+		t.Errorf("LastSeq() != 5 (= %d)", last)
+	}
+}
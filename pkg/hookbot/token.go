@@ -0,0 +1,188 @@
+package hookbot
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Claims are restrictions carried by a token. They are covered by the token's
+// MAC, so they can't be altered without invalidating it.
+//
+// A token with claims has the form "<claims>.<mac>", where the claims are
+// dash separated fields each identified by a leading letter, for example
+// "e1700000000.<mac>" for a token which expires at that Unix time. The MAC is
+// computed over the path, a NUL byte and the claims. Plain tokens have no
+// claims and no ".".
+type Claims struct {
+	Expires time.Time // Zero if the token never expires.
+
+	// If either is set, the token may only be used in that direction,
+	// otherwise it is valid for both.
+	Publish, Subscribe bool
+
+	// If set, the token is only valid for the exact path it was made for,
+	// and not for paths below it. Paths ending in "/" are recursive, so an
+	// exact token is never valid for them.
+	Exact bool
+
+	// If non-zero, the largest message body which may be published.
+	MaxSize int64
+}
+
+func (c Claims) String() string {
+	fields := []string{}
+	if !c.Expires.IsZero() {
+		fields = append(fields, fmt.Sprintf("e%d", c.Expires.Unix()))
+	}
+
+	capabilities := ""
+	if c.Publish {
+		capabilities += "p"
+	}
+	if c.Subscribe {
+		capabilities += "s"
+	}
+	if c.Exact {
+		capabilities += "x"
+	}
+	if capabilities != "" {
+		fields = append(fields, "c"+capabilities)
+	}
+
+	if c.MaxSize != 0 {
+		fields = append(fields, fmt.Sprintf("m%d", c.MaxSize))
+	}
+	return strings.Join(fields, "-")
+}
+
+func ParseClaims(s string) (Claims, error) {
+	var c Claims
+	if s == "" {
+		return c, nil
+	}
+
+	for _, field := range strings.Split(s, "-") {
+		if field == "" {
+			return c, fmt.Errorf("empty claim in %q", s)
+		}
+		value := field[1:]
+
+		switch field[0] {
+		case 'e':
+			unix, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return c, fmt.Errorf("bad expiry claim %q", field)
+			}
+			c.Expires = time.Unix(unix, 0)
+		case 'c':
+			for _, capability := range value {
+				switch capability {
+				case 'p':
+					c.Publish = true
+				case 's':
+					c.Subscribe = true
+				case 'x':
+					c.Exact = true
+				default:
+					return c, fmt.Errorf("unknown capability in %q", field)
+				}
+			}
+		case 'm':
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size <= 0 {
+				return c, fmt.Errorf("bad max size claim %q", field)
+			}
+			c.MaxSize = size
+		default:
+			return c, fmt.Errorf("unknown claim %q", field)
+		}
+	}
+	return c, nil
+}
+
+// Permits returns true if the token's direction restrictions allow `r`.
+func (c Claims) Permits(r *http.Request) bool {
+	if !c.Publish && !c.Subscribe {
+		return true
+	}
+	if IsPublishRequest(r) {
+		return c.Publish
+	}
+	return c.Subscribe
+}
+
+// IsPublishRequest returns true if `r` publishes a message rather than
+// subscribes to them.
+func IsPublishRequest(r *http.Request) bool {
+	path := strings.TrimPrefix(r.URL.Path, "/unsafe")
+	switch {
+	case strings.HasPrefix(path, "/pub/"):
+		return true
+	case strings.HasPrefix(path, "/sub/"), strings.HasPrefix(path, "/poll/"):
+		return false
+	}
+	// See BothPubSub.
+	return r.Method == "POST"
+}
+
+type claimsKey struct{}
+
+// WithClaims returns a copy of `r` carrying the claims of its token.
+func WithClaims(r *http.Request, c Claims) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), claimsKey{}, c))
+}
+
+// RequestClaims returns the claims of the token which authorized `r`.
+func RequestClaims(r *http.Request) Claims {
+	c, _ := r.Context().Value(claimsKey{}).(Claims)
+	return c
+}
+
+type verifiedTokenKey struct{}
+
+// Returns a copy of `r` recording that `token` was checked and authorized it.
+func withVerifiedToken(r *http.Request, token string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), verifiedTokenKey{}, token))
+}
+
+// The token which authorized `r`, if it was authorized by a token rather
+// than being unsafe or authorized by a client certificate.
+func verifiedToken(r *http.Request) (string, bool) {
+	token, ok := r.Context().Value(verifiedTokenKey{}).(string)
+	return token, ok
+}
+
+// Split a token into its claims (empty for a plain token) and its MAC.
+func splitToken(token string) (claims, mac string) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return "", token
+	}
+	return token[:i], token[i+1:]
+}
+
+// The message which is MACed for a token on `path` with `claims`.
+func tokenPayload(path, claims string) string {
+	if claims == "" {
+		return path // Plain tokens are a MAC of the path alone.
+	}
+	return path + "\x00" + claims
+}
+
+// MakeToken returns a token for `path` carrying `claims`.
+func MakeToken(algorithm, key, path string, claims Claims) (string, error) {
+	encoded := claims.String()
+
+	mac, err := HMAC(algorithm, key, tokenPayload(path, encoded))
+	if err != nil {
+		return "", err
+	}
+	if encoded == "" {
+		return mac, nil
+	}
+	return encoded + "." + mac, nil
+}
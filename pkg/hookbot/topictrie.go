@@ -0,0 +1,144 @@
+package hookbot
+
+import "strings"
+
+// TopicTrie indexes listeners by topic, so that the listeners interested in a
+// published topic can be found in time proportional to the depth of the topic
+// rather than the number of subscribed topics.
+//
+// Topics are split after each "/", so that a recursive topic such as "foo/"
+// is a node which every topic below it passes through.
+// Not safe for concurrent use; it belongs to Loop.
+type TopicTrie struct {
+	root topicNode
+
+	// Legacy "?recursive" topics which don't end in a "/" match by string
+	// prefix rather than by path, so they can't live in the trie.
+	// They are rare, so they are checked one by one.
+	prefixes map[string]map[Listener]struct{}
+}
+
+type topicNode struct {
+	children  map[string]*topicNode
+	exact     map[Listener]struct{} // Listening on exactly this topic.
+	recursive map[Listener]struct{} // Listening on this topic and below.
+}
+
+func NewTopicTrie() *TopicTrie {
+	return &TopicTrie{prefixes: map[string]map[Listener]struct{}{}}
+}
+
+// Split topic into path components, each keeping its trailing "/".
+func topicSegments(topic string) []string {
+	segments := strings.SplitAfter(topic, "/")
+	if segments[len(segments)-1] == "" {
+		segments = segments[:len(segments)-1]
+	}
+	return segments
+}
+
+func (t *TopicTrie) Add(l Listener) {
+	topic, isRec := recursive(l.Topic)
+
+	if isRec && topic != "" && !strings.HasSuffix(topic, "/") {
+		if _, ok := t.prefixes[topic]; !ok {
+			t.prefixes[topic] = map[Listener]struct{}{}
+		}
+		t.prefixes[topic][l] = struct{}{}
+		return
+	}
+
+	node := &t.root
+	for _, segment := range topicSegments(topic) {
+		child, ok := node.children[segment]
+		if !ok {
+			child = &topicNode{}
+			if node.children == nil {
+				node.children = map[string]*topicNode{}
+			}
+			node.children[segment] = child
+		}
+		node = child
+	}
+
+	if isRec {
+		if node.recursive == nil {
+			node.recursive = map[Listener]struct{}{}
+		}
+		node.recursive[l] = struct{}{}
+	} else {
+		if node.exact == nil {
+			node.exact = map[Listener]struct{}{}
+		}
+		node.exact[l] = struct{}{}
+	}
+}
+
+func (t *TopicTrie) Del(l Listener) {
+	topic, isRec := recursive(l.Topic)
+
+	if isRec && topic != "" && !strings.HasSuffix(topic, "/") {
+		delete(t.prefixes[topic], l)
+		if len(t.prefixes[topic]) == 0 {
+			delete(t.prefixes, topic)
+		}
+		return
+	}
+
+	segments := topicSegments(topic)
+	path := []*topicNode{&t.root}
+	node := &t.root
+	for _, segment := range segments {
+		node = node.children[segment]
+		if node == nil {
+			return // Not present.
+		}
+		path = append(path, node)
+	}
+
+	if isRec {
+		delete(node.recursive, l)
+	} else {
+		delete(node.exact, l)
+	}
+
+	// Prune nodes which no longer lead to any listeners.
+	for i := len(path) - 1; i > 0; i-- {
+		n := path[i]
+		if len(n.children) > 0 || len(n.exact) > 0 || len(n.recursive) > 0 {
+			break
+		}
+		delete(path[i-1].children, segments[i-1])
+	}
+}
+
+// Interested returns the set of listeners which should receive a message
+// published on `topic`.
+func (t *TopicTrie) Interested(topic string) map[Listener]struct{} {
+	ls := map[Listener]struct{}{}
+	add := func(from map[Listener]struct{}) {
+		for l := range from {
+			ls[l] = struct{}{}
+		}
+	}
+
+	node := &t.root
+	add(node.recursive)
+	for _, segment := range topicSegments(topic) {
+		node = node.children[segment]
+		if node == nil {
+			break
+		}
+		add(node.recursive)
+	}
+	if node != nil {
+		add(node.exact)
+	}
+
+	for prefix, candidateLs := range t.prefixes {
+		if strings.HasPrefix(topic, prefix) {
+			add(candidateLs)
+		}
+	}
+	return ls
+}
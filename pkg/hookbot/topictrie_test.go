@@ -0,0 +1,109 @@
+package hookbot
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func newTestListener(topic string) Listener {
+	return Listener{Topic: topic, c: make(chan Message)}
+}
+
+// The listeners a topic's message is delivered to, by brute force, as Loop
+// used to determine them.
+func interestedReference(ls []Listener, topic string) map[Listener]struct{} {
+	interested := map[Listener]struct{}{}
+	for _, l := range ls {
+		candidate, isRec := recursive(l.Topic)
+		if l.Topic == topic || (isRec && strings.HasPrefix(topic, candidate)) {
+			interested[l] = struct{}{}
+		}
+	}
+	return interested
+}
+
+func topicsOf(ls map[Listener]struct{}) string {
+	topics := []string{}
+	for l := range ls {
+		topics = append(topics, l.Topic)
+	}
+	sort.Strings(topics)
+	return fmt.Sprint(topics)
+}
+
+func TestTopicTrieMatchesReference(t *testing.T) {
+	subscriptions := []string{
+		"", "/", "/unsafe/", "/unsafe/github.com/", "foo", "foo/", "foo/bar",
+		"foo/bar/", "foo/bar/baz", "foo?recursive", "fo?recursive",
+		"?recursive", "foo/b?recursive", "bar/",
+	}
+	published := []string{
+		"", "/", "/unsafe/github.com/org/x", "foo", "foo/", "foobar",
+		"foo/bar", "foo/bar/", "foo/bar/baz", "foo/baz", "bar", "bar/x",
+	}
+
+	trie := NewTopicTrie()
+	ls := []Listener{}
+	for _, topic := range subscriptions {
+		l := newTestListener(topic)
+		ls = append(ls, l)
+		trie.Add(l)
+	}
+
+	check := func() {
+		for _, topic := range published {
+			got := topicsOf(trie.Interested(topic))
+			expected := topicsOf(interestedReference(ls, topic))
+			if got != expected {
+				t.Errorf("Interested(%q) = %v, expected %v",
+					topic, got, expected)
+			}
+		}
+	}
+	check()
+
+	// Remove every other listener, and check that nothing is left behind.
+	remaining := []Listener{}
+	for i, l := range ls {
+		if i%2 == 0 {
+			trie.Del(l)
+		} else {
+			remaining = append(remaining, l)
+		}
+	}
+	ls = remaining
+	check()
+
+	for _, l := range ls {
+		trie.Del(l)
+	}
+	if len(trie.root.children) != 0 || len(trie.prefixes) != 0 {
+		t.Errorf("Trie not empty after removing all listeners")
+	}
+}
+
+func benchmarkInterested(b *testing.B, nRepos int) {
+	trie := NewTopicTrie()
+	for i := 0; i < nRepos; i++ {
+		repo := fmt.Sprintf("github.com/repo/org%d/repo%d/", i%100, i)
+		trie.Add(newTestListener(repo))
+		trie.Add(newTestListener(repo + "branch/master"))
+	}
+	trie.Add(newTestListener("/unsafe/github.com/"))
+
+	topic := fmt.Sprintf("github.com/repo/org%d/repo%d/branch/master",
+		(nRepos/2)%100, nRepos/2)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if len(trie.Interested(topic)) != 2 {
+			b.Fatal("Expected two interested listeners")
+		}
+	}
+}
+
+func BenchmarkInterested10(b *testing.B)     { benchmarkInterested(b, 10) }
+func BenchmarkInterested1000(b *testing.B)   { benchmarkInterested(b, 1000) }
+func BenchmarkInterested100000(b *testing.B) { benchmarkInterested(b, 100000) }
@@ -10,6 +10,7 @@ import (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    []string{EnvelopeSubprotocol},
 }
 
 type WebsocketHandlerFunc func(*websocket.Conn, *http.Request)
@@ -27,10 +27,33 @@ func (e *ErrConnectionFail) Error() string {
 	return fmt.Sprintf("failed: %v", err)
 }
 
+// DefaultMaxMessageSize is the largest message Watch accepts, in bytes,
+// unless given the MaxMessageSize option.
+const DefaultMaxMessageSize = 1 << 20
+
+// An Option changes the behaviour of Watch or RetryingWatch.
+type Option func(*options)
+
+type options struct {
+	maxMessageSize int64
+}
+
+// MaxMessageSize sets the largest message accepted, in bytes. Larger messages
+// close the connection with an error. It should be at least the server's
+// maximum publish size.
+func MaxMessageSize(size int64) Option {
+	return func(o *options) { o.maxMessageSize = size }
+}
+
 func Watch(
-	target string, header http.Header, finish <-chan struct{},
+	target string, header http.Header, finish <-chan struct{}, opts ...Option,
 ) (<-chan []byte, <-chan error, error) {
 
+	o := options{maxMessageSize: DefaultMaxMessageSize}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	u, err := url.Parse(target)
 	if err != nil {
 		return nil, nil, err
@@ -68,8 +91,7 @@ func Watch(
 		pongWait = 40 * time.Second
 	)
 
-	const MiB = 1 << 20
-	conn.SetReadLimit(1 * MiB)
+	conn.SetReadLimit(o.maxMessageSize)
 
 	conn.SetReadDeadline(time.Now().Add(pongWait))
 	conn.SetPongHandler(func(string) error {
@@ -152,7 +174,7 @@ func Watch(
 // This function is like Watch() except if the transport fails, it is
 // automatically retried.
 func RetryingWatch(
-	target string, header http.Header, finish <-chan struct{},
+	target string, header http.Header, finish <-chan struct{}, opts ...Option,
 ) (<-chan []byte, <-chan error) {
 
 	outm := make(chan []byte)
@@ -166,7 +188,7 @@ func RetryingWatch(
 		defer wg.Wait()
 
 		for {
-			ms, errs, err := Watch(target, header, finish)
+			ms, errs, err := Watch(target, header, finish, opts...)
 			if err != nil {
 				oute <- err
 				goto retry
@@ -0,0 +1,40 @@
+package listen
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// Messages larger than MaxMessageSize end the watch with an error.
+func TestWatchMaxMessageSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte("small"))
+		conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 100)))
+		conn.ReadMessage() // Wait for the client to hang up.
+	}))
+	defer server.Close()
+
+	finish := make(chan struct{})
+	defer close(finish)
+
+	messages, errs, err := Watch(server.URL, http.Header{}, finish, MaxMessageSize(10))
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+
+	if m := <-messages; string(m) != "small" {
+		t.Errorf("First message = %q, expected %q", m, "small")
+	}
+	if err := <-errs; err != websocket.ErrReadLimit {
+		t.Errorf("Error = %v, expected %v", err, websocket.ErrReadLimit)
+	}
+}
@@ -9,6 +9,9 @@ import (
 	"net/url"
 )
 
+// Message is a request as wrapped by ?extra-metadata=headers. The body is
+// carried as a JSON string, so bytes in it which aren't valid UTF-8 are
+// replaced with U+FFFD.
 type Message struct {
 	*http.Request
 }
@@ -48,7 +51,18 @@ func (r Message) MarshalJSON() ([]byte, error) {
 		return nil, err
 	}
 
+	method, err := asJSON(r.Method)
+	if err != nil {
+		return nil, err
+	}
+	query, err := asJSON(r.URL.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(&buf, `"Method": %s, `, method)
 	fmt.Fprintf(&buf, `"URL": "%s", `, r.URL.Path)
+	fmt.Fprintf(&buf, `"Query": %s, `, query)
 	fmt.Fprintf(&buf, `"RemoteAddr": "%s", `, r.RemoteAddr)
 	fmt.Fprintf(&buf, `"Header": %s, `, header)
 
@@ -81,7 +95,9 @@ func (r *Message) UnmarshalJSON(data []byte) error {
 	}
 
 	type DecodeBuf struct {
+		Method     string
 		URL        string
+		Query      string
 		RemoteAddr string
 		Header     http.Header
 		Body       string
@@ -97,7 +113,9 @@ func (r *Message) UnmarshalJSON(data []byte) error {
 	if err != nil {
 		return fmt.Errorf("error parsing URL %q: %v", d.URL, err)
 	}
+	r.URL.RawQuery = d.Query
 	r.RequestURI = r.URL.RequestURI()
+	r.Method = d.Method
 	r.RemoteAddr = d.RemoteAddr
 	r.Header = d.Header
 	r.Body = ioutil.NopCloser(bytes.NewBuffer([]byte(d.Body)))
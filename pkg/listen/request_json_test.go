@@ -8,7 +8,7 @@ import (
 )
 
 func TestRoundtripRequest(t *testing.T) {
-	r, _ := http.NewRequest("GET", "/foo", bytes.NewReader([]byte("MESSAGE")))
+	r, _ := http.NewRequest("POST", "/foo?bar=baz", bytes.NewReader([]byte("MESSAGE")))
 
 	marshalled, err := json.Marshal(Message{r})
 	if err != nil {
@@ -25,5 +25,11 @@ func TestRoundtripRequest(t *testing.T) {
 	if r.URL.Path != "/foo" {
 		t.Errorf("r.URL.Path != /foo (== %q)", r.URL.Path)
 	}
+	if r.URL.RawQuery != "bar=baz" {
+		t.Errorf("r.URL.RawQuery != bar=baz (== %q)", r.URL.RawQuery)
+	}
+	if r.Method != "POST" {
+		t.Errorf("r.Method != POST (== %q)", r.Method)
+	}
 
 }
@@ -0,0 +1,240 @@
+// Package bitbucket routes Bitbucket Cloud webhooks, published to
+// /unsafe/pub/bitbucket.org/... with ?extra-metadata=bitbucket, to
+// per-repository topics.
+package bitbucket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/urfave/cli"
+
+	"github.com/sensiblecodeio/hookbot/pkg/hookbot"
+	"github.com/sensiblecodeio/hookbot/pkg/router"
+)
+
+type Summary = router.Summary
+
+// Host is the host which Bitbucket Cloud webhooks are consumed from and
+// republished under.
+const Host = "bitbucket.org"
+
+// Event holds the parts of a Bitbucket webhook payload which Router uses.
+// Which fields are set depends on Key, the X-Event-Key header.
+type Event struct {
+	Key string
+
+	Repository *Repository `json:"repository"`
+	Actor      *User       `json:"actor"`
+
+	Push        *Push        `json:"push"`
+	PullRequest *PullRequest `json:"pullrequest"`
+}
+
+type Repository struct {
+	FullName string `json:"full_name"`
+}
+
+type User struct {
+	Nickname    string `json:"nickname"`
+	DisplayName string `json:"display_name"`
+}
+
+type Push struct {
+	Changes []Change `json:"changes"`
+}
+
+// A Change to one ref in a push. New is nil if the ref was deleted, and Old
+// is nil if it was created.
+type Change struct {
+	New *Ref `json:"new"`
+	Old *Ref `json:"old"`
+}
+
+type Ref struct {
+	Type   string `json:"type"` // "branch" or "tag".
+	Name   string `json:"name"`
+	Target struct {
+		Hash string `json:"hash"`
+	} `json:"target"`
+}
+
+type PullRequest struct {
+	ID     int `json:"id"`
+	Source struct {
+		Branch struct {
+			Name string `json:"name"`
+		} `json:"branch"`
+		Commit struct {
+			Hash string `json:"hash"`
+		} `json:"commit"`
+	} `json:"source"`
+	Links struct {
+		HTML struct {
+			Href string `json:"href"`
+		} `json:"html"`
+	} `json:"links"`
+}
+
+// Who caused the event.
+func (e *Event) Who() string {
+	switch {
+	case e.Actor == nil:
+		return "<unknown>"
+	case e.Actor.Nickname != "":
+		return e.Actor.Nickname
+	}
+	return e.Actor.DisplayName
+}
+
+// Pull request events which are routed, with their actions as GitHub names
+// them.
+var pullRequestActions = map[string]string{
+	"pullrequest:created":   "opened",
+	"pullrequest:updated":   "synchronize",
+	"pullrequest:fulfilled": "closed",
+	"pullrequest:rejected":  "closed",
+}
+
+// A topic (below the host) and the summary to publish to it.
+type Routed struct {
+	Topic   string
+	Summary Summary
+}
+
+// Route returns what to publish for an event. A push may change several refs,
+// each of which is published separately.
+func (e *Event) Route() []Routed {
+	repo := e.Repository.FullName
+	base := "repo/" + repo
+
+	summary := Summary{Repo: repo, Who: e.Who()}
+
+	switch {
+	case e.Key == "repo:push" && e.Push != nil:
+		summary.Type = "push"
+
+		var routed []Routed
+		for _, change := range e.Push.Changes {
+			s := summary
+			ref := change.New
+			if ref == nil {
+				ref = change.Old
+				s.Deleted = true
+			} else {
+				s.SHA = ref.Target.Hash
+			}
+			if ref == nil {
+				continue
+			}
+
+			switch ref.Type {
+			case "branch":
+				s.Branch = ref.Name
+			case "tag":
+				s.Tag = ref.Name
+			default:
+				continue
+			}
+			routed = append(routed, Routed{
+				fmt.Sprintf("%s/%s/%s", base, ref.Type, ref.Name), s})
+		}
+		return routed
+
+	case e.PullRequest != nil:
+		action, ok := pullRequestActions[e.Key]
+		if !ok {
+			return nil
+		}
+		pr := e.PullRequest
+		summary.Type = "pull_request"
+		summary.Action = action
+		summary.Number = pr.ID
+		summary.Branch = pr.Source.Branch.Name
+		summary.SHA = pr.Source.Commit.Hash
+		summary.Merged = e.Key == "pullrequest:fulfilled"
+		summary.URL = pr.Links.HTML.Href
+		return []Routed{{fmt.Sprintf("%s/pull/%d", base, pr.ID), summary}}
+	}
+
+	return nil
+}
+
+type Router struct {
+	Secret string // Signs the webhooks' X-Hub-Signature.
+}
+
+func (r *Router) Name() string {
+	return "bitbucket"
+}
+
+func (r *Router) Configure(c *cli.Context) error {
+	r.Secret = c.String("bitbucket-secret")
+	if r.Secret == "" {
+		return errors.New("--bitbucket-secret is required")
+	}
+	return nil
+}
+
+func (r *Router) Topics() []string {
+	return []string{"/unsafe/" + Host + "/"}
+}
+
+func (r *Router) Route(in hookbot.Message, publish func(hookbot.Message) bool) {
+
+	log.Printf("route bitbucket: %q", in.Topic)
+
+	var m struct {
+		Signature, Event string
+		Payload          []byte
+	}
+
+	err := json.Unmarshal(in.Body, &m)
+	if err != nil {
+		log.Printf("Failed to unmarshal bitbucket message: %v", err)
+		return
+	}
+
+	expected := "sha256=" + hookbot.Sha256HMAC(r.Secret, string(m.Payload))
+	if !hookbot.SecureEqual(m.Signature, expected) {
+		log.Printf("Reject bitbucket signature")
+		return
+	}
+
+	var event Event
+	event.Key = m.Event
+
+	err = json.Unmarshal(m.Payload, &event)
+	if err != nil {
+		log.Printf("Route: error in json.Unmarshal: %v", err)
+		return
+	}
+
+	if event.Repository == nil || event.Repository.FullName == "" {
+		log.Printf("Could not identify repository for event %v", event.Key)
+		return
+	}
+
+	routed := event.Route()
+	if len(routed) == 0 {
+		log.Printf("Unhandled event type: %v", event.Key)
+		return
+	}
+
+	for _, out := range routed {
+		msgBytes, err := json.Marshal(out.Summary)
+		if err != nil {
+			log.Printf("Failed to marshal Summary: %v", err)
+			return
+		}
+
+		// Refs are independent, so carry on with the rest if one fails.
+		_ = publish(hookbot.Message{Topic: Host + "/" + out.Topic, Body: msgBytes})
+	}
+}
+
+func init() {
+	hookbot.RegisterRouter(&Router{})
+}
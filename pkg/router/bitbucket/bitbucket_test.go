@@ -0,0 +1,81 @@
+package bitbucket
+
+import (
+	"testing"
+
+	"github.com/sensiblecodeio/hookbot/pkg/hookbot"
+	"github.com/sensiblecodeio/hookbot/pkg/router/routertest"
+)
+
+const secret = "bitbucket_secret"
+
+// Route an event through Router, returning what it published.
+func route(t *testing.T, signature, event, payload string) []hookbot.Message {
+	return routertest.Route(t, &Router{Secret: secret},
+		routertest.Metadata{Signature: signature, Event: event, Payload: []byte(payload)})
+}
+
+func sign(payload string) string {
+	return "sha256=" + hookbot.Sha256HMAC(secret, payload)
+}
+
+// Each ref changed by a push is published separately.
+func TestRoutePush(t *testing.T) {
+	payload := `{
+		"repository": {"full_name": "team/app"},
+		"actor": {"nickname": "jo", "display_name": "Jo Bloggs"},
+		"push": {"changes": [
+			{"new": {"type": "branch", "name": "main", "target": {"hash": "abc"}}},
+			{"old": {"type": "tag", "name": "v1", "target": {"hash": "def"}}}
+		]}
+	}`
+
+	published := route(t, sign(payload), "repo:push", payload)
+
+	expected := []struct{ topic, summary string }{
+		{
+			"bitbucket.org/repo/team/app/branch/main",
+			`{"Type":"push","Repo":"team/app","Branch":"main","SHA":"abc","Who":"jo"}`,
+		},
+		{
+			"bitbucket.org/repo/team/app/tag/v1",
+			`{"Type":"push","Repo":"team/app","Branch":"","SHA":"","Who":"jo","Tag":"v1","Deleted":true}`,
+		},
+	}
+	if len(published) != len(expected) {
+		t.Fatalf("Published %d messages, expected %d", len(published), len(expected))
+	}
+	for i, e := range expected {
+		if published[i].Topic != e.topic || string(published[i].Body) != e.summary {
+			t.Errorf("Published %q %s, expected %q %s",
+				published[i].Topic, published[i].Body, e.topic, e.summary)
+		}
+	}
+}
+
+func TestRoutePullRequest(t *testing.T) {
+	payload := `{
+		"repository": {"full_name": "team/app"},
+		"actor": {"display_name": "Jo Bloggs"},
+		"pullrequest": {
+			"id": 9,
+			"source": {"branch": {"name": "feature"}, "commit": {"hash": "abc"}},
+			"links": {"html": {"href": "https://bitbucket.org/pr"}}
+		}
+	}`
+
+	published := route(t, sign(payload), "pullrequest:fulfilled", payload)
+	if len(published) != 1 {
+		t.Fatalf("Published %d messages, expected 1", len(published))
+	}
+
+	const summary = `{"Type":"pull_request","Repo":"team/app","Branch":"feature","SHA":"abc","Who":"Jo Bloggs","Action":"closed","Number":9,"Merged":true,"URL":"https://bitbucket.org/pr"}`
+	if published[0].Topic != "bitbucket.org/repo/team/app/pull/9" ||
+		string(published[0].Body) != summary {
+		t.Errorf("Published %q %s", published[0].Topic, published[0].Body)
+	}
+
+	if published := route(t, "sha256=bad", "pullrequest:fulfilled", payload); len(published) != 0 {
+		t.Errorf("Bad signature: published %v", published)
+	}
+}
@@ -0,0 +1,191 @@
+// Package gitea routes Gitea and Forgejo webhooks, published to
+// /unsafe/pub/<host>/... with ?extra-metadata=gitea, to per-repository topics.
+package gitea
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/urfave/cli"
+
+	"github.com/sensiblecodeio/hookbot/pkg/hookbot"
+	"github.com/sensiblecodeio/hookbot/pkg/router"
+)
+
+type Summary = router.Summary
+
+// Event holds the parts of a Gitea webhook payload which Router uses. Which
+// fields are set depends on Type, the X-Gitea-Event header.
+type Event struct {
+	Type string
+
+	Repository *Repository `json:"repository"`
+	Pusher     *User       `json:"pusher"`
+	Sender     *User       `json:"sender"`
+
+	Ref    string `json:"ref"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+
+	Action      string       `json:"action"`
+	PullRequest *PullRequest `json:"pull_request"`
+}
+
+type Repository struct {
+	FullName string `json:"full_name"`
+}
+
+type User struct {
+	Login string `json:"login"`
+}
+
+type PullRequest struct {
+	Number  int    `json:"number"`
+	HTMLURL string `json:"html_url"`
+	Merged  bool   `json:"merged"`
+	Head    struct {
+		Ref string `json:"ref"`
+		SHA string `json:"sha"`
+	} `json:"head"`
+}
+
+// Who caused the event.
+func (e *Event) Who() string {
+	switch {
+	case e.Pusher != nil:
+		return e.Pusher.Login
+	case e.Sender != nil:
+		return e.Sender.Login
+	}
+	return "<unknown>"
+}
+
+// Pull request actions which are routed, as GitHub names them.
+var pullRequestActions = map[string]string{
+	"opened":       "opened",
+	"synchronized": "synchronize",
+	"closed":       "closed",
+}
+
+// Route returns the topic (below the host) and summary for an event, or
+// ok = false if it isn't a push or pull request. Gitea's payloads follow
+// GitHub's, so only the pull request actions need translating.
+func (e *Event) Route() (topic string, summary Summary, ok bool) {
+	repo := e.Repository.FullName
+	base := "repo/" + repo
+
+	summary = Summary{
+		Type: e.Type,
+		Repo: repo,
+		Who:  e.Who(),
+	}
+
+	switch e.Type {
+	case "push":
+		summary.SHA = e.After
+		summary.Deleted = router.IsDeletion(e.After)
+		if tag, ok := strings.CutPrefix(e.Ref, "refs/tags/"); ok {
+			summary.Tag = tag
+			return fmt.Sprintf("%s/tag/%s", base, tag), summary, true
+		}
+		summary.Branch = strings.TrimPrefix(e.Ref, "refs/heads/")
+		return fmt.Sprintf("%s/branch/%s", base, summary.Branch), summary, true
+
+	case "pull_request":
+		action, ok := pullRequestActions[e.Action]
+		if !ok || e.PullRequest == nil {
+			return "", Summary{}, false
+		}
+		pr := e.PullRequest
+		summary.Action = action
+		summary.Number = pr.Number
+		summary.Branch = pr.Head.Ref
+		summary.SHA = pr.Head.SHA
+		summary.Merged = pr.Merged
+		summary.URL = pr.HTMLURL
+		return fmt.Sprintf("%s/pull/%d", base, pr.Number), summary, true
+	}
+
+	return "", Summary{}, false
+}
+
+type Router struct {
+	Host   string // Webhooks are consumed from /unsafe/<Host>/.
+	Secret string // Signs the webhooks' X-Gitea-Signature.
+}
+
+func (r *Router) Name() string {
+	return "gitea"
+}
+
+func (r *Router) Configure(c *cli.Context) error {
+	r.Host = c.String("gitea-host")
+	r.Secret = c.String("gitea-secret")
+	if r.Secret == "" {
+		return errors.New("--gitea-secret is required")
+	}
+	return nil
+}
+
+func (r *Router) Topics() []string {
+	return []string{"/unsafe/" + r.Host + "/"}
+}
+
+func (r *Router) Route(in hookbot.Message, publish func(hookbot.Message) bool) {
+
+	log.Printf("route gitea: %q", in.Topic)
+
+	var m struct {
+		Signature, Event string
+		Payload          []byte
+	}
+
+	err := json.Unmarshal(in.Body, &m)
+	if err != nil {
+		log.Printf("Failed to unmarshal gitea message: %v", err)
+		return
+	}
+
+	// Gitea signs with the bare hex HMAC-SHA256 of the payload.
+	expected := hookbot.Sha256HMAC(r.Secret, string(m.Payload))
+	if !hookbot.SecureEqual(m.Signature, expected) {
+		log.Printf("Reject gitea signature")
+		return
+	}
+
+	var event Event
+	event.Type = m.Event
+
+	err = json.Unmarshal(m.Payload, &event)
+	if err != nil {
+		log.Printf("Route: error in json.Unmarshal: %v", err)
+		return
+	}
+
+	if event.Repository == nil || event.Repository.FullName == "" {
+		log.Printf("Could not identify repository for event %v", event.Type)
+		return
+	}
+
+	topic, summary, ok := event.Route()
+	if !ok {
+		log.Printf("Unhandled event type: %v (action %q)", event.Type, event.Action)
+		return
+	}
+
+	msgBytes, err := json.Marshal(summary)
+	if err != nil {
+		log.Printf("Failed to marshal Summary: %v", err)
+		return
+	}
+
+	// If this fails, the delivery still shows as successful in Gitea.
+	_ = publish(hookbot.Message{Topic: r.Host + "/" + topic, Body: msgBytes})
+}
+
+func init() {
+	hookbot.RegisterRouter(&Router{Host: "gitea.com"})
+}
@@ -0,0 +1,67 @@
+package gitea
+
+import (
+	"testing"
+
+	"github.com/sensiblecodeio/hookbot/pkg/hookbot"
+	"github.com/sensiblecodeio/hookbot/pkg/router/routertest"
+)
+
+const secret = "gitea_secret"
+
+// Route an event through Router, returning what it published.
+func route(t *testing.T, signature, event, payload string) []hookbot.Message {
+	return routertest.Route(t, &Router{Host: "git.example.com", Secret: secret},
+		routertest.Metadata{Signature: signature, Event: event, Payload: []byte(payload)})
+}
+
+func TestRouteEvents(t *testing.T) {
+	const repo = `"repository": {"full_name": "org/app"}, "sender": {"login": "jo"}`
+
+	for _, tc := range []struct {
+		event, payload string
+		topic, summary string
+	}{
+		{
+			"push",
+			`{"ref": "refs/heads/main", "after": "abc", "pusher": {"login": "kim"}, ` + repo + `}`,
+			"git.example.com/repo/org/app/branch/main",
+			`{"Type":"push","Repo":"org/app","Branch":"main","SHA":"abc","Who":"kim"}`,
+		},
+		{
+			"push",
+			`{"ref": "refs/tags/v1", "after": "abc", ` + repo + `}`,
+			"git.example.com/repo/org/app/tag/v1",
+			`{"Type":"push","Repo":"org/app","Branch":"","SHA":"abc","Who":"jo","Tag":"v1"}`,
+		},
+		{
+			"pull_request",
+			`{"action": "synchronized", "pull_request": {"number": 5, "html_url": "https://git.example.com/pr", "head": {"ref": "feature", "sha": "def"}}, ` + repo + `}`,
+			"git.example.com/repo/org/app/pull/5",
+			`{"Type":"pull_request","Repo":"org/app","Branch":"feature","SHA":"def","Who":"jo","Action":"synchronize","Number":5,"URL":"https://git.example.com/pr"}`,
+		},
+	} {
+		signature := hookbot.Sha256HMAC(secret, tc.payload)
+		published := route(t, signature, tc.event, tc.payload)
+		if len(published) != 1 {
+			t.Errorf("%v: published %d messages, expected 1", tc.topic, len(published))
+			continue
+		}
+		if published[0].Topic != tc.topic {
+			t.Errorf("Topic %q, expected %q", published[0].Topic, tc.topic)
+		}
+		if string(published[0].Body) != tc.summary {
+			t.Errorf("%v: summary %s, expected %s", tc.topic, published[0].Body, tc.summary)
+		}
+	}
+}
+
+func TestRouteRejectsBadSignature(t *testing.T) {
+	payload := `{"ref": "refs/heads/main", "repository": {"full_name": "org/app"}}`
+
+	for _, signature := range []string{"", hookbot.Sha256HMAC("wrong", payload)} {
+		if published := route(t, signature, "push", payload); len(published) != 0 {
+			t.Errorf("Signature %q: published %v", signature, published)
+		}
+	}
+}
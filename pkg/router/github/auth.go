@@ -3,6 +3,7 @@ package github
 import (
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/json"
 	"fmt"
@@ -15,6 +16,12 @@ func Sha1HMAC(key string, payload []byte) string {
 	return fmt.Sprintf("%x", mac.Sum(nil))
 }
 
+func Sha256HMAC(key string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	_, _ = mac.Write(payload)
+	return fmt.Sprintf("%x", mac.Sum(nil))
+}
+
 func SecureEqual(x, y string) bool {
 	if subtle.ConstantTimeCompare([]byte(x), []byte(y)) == 1 {
 		return true
@@ -23,10 +30,18 @@ func SecureEqual(x, y string) bool {
 }
 
 func IsValidGithubSignature(secret string, message []byte) bool {
+	return CheckGithubSignature(secret, message, false)
+}
+
+// CheckGithubSignature verifies a message captured with
+// ?extra-metadata=github. The X-Hub-Signature-256 signature is checked in
+// preference to the SHA-1 X-Hub-Signature. If requireSHA256 is set, messages
+// without a SHA-256 signature are rejected.
+func CheckGithubSignature(secret string, message []byte, requireSHA256 bool) bool {
 
 	type GithubMessage struct {
-		Signature string
-		Payload   []byte
+		Signature, Signature256 string
+		Payload                 []byte
 	}
 
 	var m GithubMessage
@@ -38,8 +53,18 @@ func IsValidGithubSignature(secret string, message []byte) bool {
 		return false
 	}
 
-	expected := m.Signature
-	got := fmt.Sprintf("sha1=%v", Sha1HMAC(secret, m.Payload))
+	var expected, got string
+	switch {
+	case m.Signature256 != "":
+		expected = m.Signature256
+		got = fmt.Sprintf("sha256=%v", Sha256HMAC(secret, m.Payload))
+	case requireSHA256:
+		log.Printf("Message has no SHA-256 signature")
+		return false
+	default:
+		expected = m.Signature
+		got = fmt.Sprintf("sha1=%v", Sha1HMAC(secret, m.Payload))
+	}
 
 	log.Printf("Expected = %v got = %v", expected, got)
 
@@ -0,0 +1,42 @@
+package github
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func githubMessage(signature, signature256 string, payload []byte) []byte {
+	message, _ := json.Marshal(map[string]interface{}{
+		"Signature":    signature,
+		"Signature256": signature256,
+		"Payload":      payload,
+	})
+	return message
+}
+
+func TestCheckGithubSignature(t *testing.T) {
+	const secret = "github_secret"
+	payload := []byte(`{"ref": "refs/heads/master"}`)
+
+	sha1 := "sha1=" + Sha1HMAC(secret, payload)
+	sha256 := "sha256=" + Sha256HMAC(secret, payload)
+
+	for _, test := range []struct {
+		signature, signature256 string
+		requireSHA256           bool
+		expected                bool
+	}{
+		{sha1, "", false, true},
+		{sha1, "", true, false},
+		{sha1, sha256, true, true},
+		{"", sha256, false, true},
+		// The SHA-256 signature takes precedence when present.
+		{sha1, "sha256=bad", false, false},
+	} {
+		message := githubMessage(test.signature, test.signature256, payload)
+		got := CheckGithubSignature(secret, message, test.requireSHA256)
+		if got != test.expected {
+			t.Errorf("CheckGithubSignature() = %v for %+v", got, test)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package github
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/sensiblecodeio/hookbot/pkg/router"
+)
+
+// Event holds the parts of a GitHub webhook payload which Router uses. Which
+// fields are set depends on Type, the X-GitHub-Event header.
+type Event struct {
+	Type string
+
+	Repository *Repository `json:"repository"`
+	Pusher     *Pusher     `json:"pusher"`
+	Sender     *User       `json:"sender"`
+
+	Ref    string `json:"ref"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+
+	Action  string `json:"action"`
+	RefType string `json:"ref_type"` // For create and delete: "branch" or "tag".
+
+	PullRequest *PullRequest `json:"pull_request"`
+	Release     *Release     `json:"release"`
+	WorkflowRun *WorkflowRun `json:"workflow_run"`
+	CheckSuite  *CheckSuite  `json:"check_suite"`
+}
+
+func (e *Event) Branch() string {
+	return strings.TrimPrefix(e.Ref, "refs/heads/")
+}
+
+// Tag returns the name of the tag pushed to, if the push was to a tag.
+func (e *Event) Tag() (string, bool) {
+	return strings.CutPrefix(e.Ref, "refs/tags/")
+}
+
+func (e *Event) IsDeletion() bool {
+	return router.IsDeletion(e.After)
+}
+
+// Who caused the event.
+func (e *Event) Who() string {
+	switch {
+	case e.Pusher != nil:
+		return e.Pusher.Name
+	case e.Sender != nil:
+		return e.Sender.Login
+	}
+	return "<unknown>"
+}
+
+type Pusher struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+type User struct {
+	Login string `json:"login"`
+}
+
+type Repository struct {
+	FullName string `json:"full_name"`
+}
+
+type PullRequest struct {
+	Number  int    `json:"number"`
+	HTMLURL string `json:"html_url"`
+	Merged  bool   `json:"merged"`
+	Head    struct {
+		Ref string `json:"ref"`
+		SHA string `json:"sha"`
+	} `json:"head"`
+}
+
+type Release struct {
+	TagName string `json:"tag_name"`
+	HTMLURL string `json:"html_url"`
+}
+
+type WorkflowRun struct {
+	Name       string `json:"name"`
+	HeadBranch string `json:"head_branch"`
+	HeadSHA    string `json:"head_sha"`
+	Status     string `json:"status"`
+	Conclusion string `json:"conclusion"`
+	HTMLURL    string `json:"html_url"`
+}
+
+type CheckSuite struct {
+	HeadBranch string `json:"head_branch"`
+	HeadSHA    string `json:"head_sha"`
+	Status     string `json:"status"`
+	Conclusion string `json:"conclusion"`
+	App        struct {
+		Slug string `json:"slug"`
+	} `json:"app"`
+}
+
+type Summary = router.Summary
+
+// Route returns the topic and summary for an event, or ok = false if it isn't
+// one which is routed.
+func (e *Event) Route() (topic string, summary Summary, ok bool) {
+	repo := e.Repository.FullName
+	base := "github.com/repo/" + repo
+
+	summary = Summary{
+		Type:   e.Type,
+		Repo:   repo,
+		Who:    e.Who(),
+		Action: e.Action,
+	}
+
+	switch e.Type {
+	case "push":
+		summary.SHA = e.After
+		summary.Deleted = e.IsDeletion()
+		if tag, ok := e.Tag(); ok {
+			summary.Tag = tag
+			return fmt.Sprintf("%s/tag/%s", base, tag), summary, true
+		}
+		summary.Branch = e.Branch()
+		return fmt.Sprintf("%s/branch/%s", base, summary.Branch), summary, true
+
+	case "pull_request":
+		switch e.Action {
+		case "opened", "synchronize", "closed":
+		default:
+			return "", Summary{}, false
+		}
+		if e.PullRequest == nil {
+			return "", Summary{}, false
+		}
+		pr := e.PullRequest
+		summary.Number = pr.Number
+		summary.Branch = pr.Head.Ref
+		summary.SHA = pr.Head.SHA
+		summary.Merged = pr.Merged
+		summary.URL = pr.HTMLURL
+		return fmt.Sprintf("%s/pull/%d", base, pr.Number), summary, true
+
+	case "create", "delete":
+		// These carry no SHA, so they go to their own topics rather than
+		// those of pushes, whose subscribers expect one.
+		summary.Deleted = e.Type == "delete"
+		switch e.RefType {
+		case "branch":
+			summary.Branch = e.Ref
+		case "tag":
+			summary.Tag = e.Ref
+		default:
+			return "", Summary{}, false
+		}
+		return fmt.Sprintf("%s/%s/%s/%s", base, e.Type, e.RefType, e.Ref),
+			summary, true
+
+	case "release":
+		if e.Release == nil {
+			return "", Summary{}, false
+		}
+		summary.Tag = e.Release.TagName
+		summary.URL = e.Release.HTMLURL
+		return fmt.Sprintf("%s/release/%s", base, summary.Tag), summary, true
+
+	case "workflow_run":
+		if e.WorkflowRun == nil {
+			return "", Summary{}, false
+		}
+		run := e.WorkflowRun
+		summary.Branch = run.HeadBranch
+		summary.SHA = run.HeadSHA
+		summary.Workflow = run.Name
+		summary.Status = run.Status
+		summary.Conclusion = run.Conclusion
+		summary.URL = run.HTMLURL
+		// Workflow names are free text.
+		return fmt.Sprintf("%s/workflow/%s", base, url.PathEscape(run.Name)),
+			summary, true
+
+	case "check_suite":
+		if e.CheckSuite == nil {
+			return "", Summary{}, false
+		}
+		suite := e.CheckSuite
+		summary.Branch = suite.HeadBranch
+		summary.SHA = suite.HeadSHA
+		summary.App = suite.App.Slug
+		summary.Status = suite.Status
+		summary.Conclusion = suite.Conclusion
+		return fmt.Sprintf("%s/check_suite/%s", base, suite.App.Slug),
+			summary, true
+	}
+
+	return "", Summary{}, false
+}
@@ -3,13 +3,13 @@ package github
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"regexp"
-	"strings"
 
 	"github.com/urfave/cli"
 
@@ -69,7 +69,8 @@ func ActionRoute(c *cli.Context) {
 	header := MustMakeHeader(target, origin, c.StringSlice("header"))
 	finish := make(chan struct{})
 
-	messages, errors := listen.RetryingWatch(target.String(), header, finish)
+	messages, errors := listen.RetryingWatch(target.String(), header, finish,
+		listen.MaxMessageSize(c.Int64("max-message-size")))
 
 	outbound := make(chan listen.Message, 1)
 
@@ -102,7 +103,10 @@ func ActionRoute(c *cli.Context) {
 		}
 	}()
 
-	router := &Router{}
+	router := &Router{
+		Secret:        c.GlobalString("github-secret"),
+		RequireSHA256: c.Bool("require-sha256"),
+	}
 
 	for mBytes := range messages {
 		log.Printf("Receive message")
@@ -111,47 +115,32 @@ func ActionRoute(c *cli.Context) {
 		topic := parts[0]
 		body := parts[1]
 
-		if !IsValidGithubSignature(c.GlobalString("github-secret"), body) {
-			log.Printf("Reject github signature")
-			continue
-		}
-
 		m := hookbot.Message{Topic: string(topic), Body: body}
 		router.Route(m, publish)
 	}
 	close(outbound)
 }
 
-type Event struct {
-	Type string
-
-	Repository *Repository `json:"repository"`
-	Pusher     *Pusher     `json:"pusher"`
-
-	Ref    string `json:"ref"`
-	Before string `json:"before"`
-	After  string `json:"after"`
-}
+type Router struct {
+	Secret string // Signs the webhooks, see CheckGithubSignature.
 
-func (e *Event) Branch() string {
-	return strings.TrimPrefix(e.Ref, "refs/heads/")
+	// If set, webhooks without an X-Hub-Signature-256 are rejected.
+	RequireSHA256 bool
 }
 
-type Pusher struct {
-	Name  string `json:"name"`
-	Email string `json:"email"`
-}
-
-type Repository struct {
-	FullName string `json:"full_name"`
-}
-
-type Router struct{}
-
 func (r *Router) Name() string {
 	return "github"
 }
 
+func (r *Router) Configure(c *cli.Context) error {
+	r.Secret = c.GlobalString("github-secret")
+	r.RequireSHA256 = c.Bool("github-require-sha256")
+	if r.Secret == "" || r.Secret == "<unset>" {
+		return errors.New("--github-secret is required")
+	}
+	return nil
+}
+
 func (r *Router) Topics() []string {
 	return []string{"/unsafe/github.com/"}
 }
@@ -160,6 +149,11 @@ func (r *Router) Route(in hookbot.Message, publish func(hookbot.Message) bool) {
 
 	log.Printf("route github: %q", in.Topic)
 
+	if !CheckGithubSignature(r.Secret, in.Body, r.RequireSHA256) {
+		log.Printf("Reject github signature")
+		return
+	}
+
 	type GithubMessage struct {
 		Event, Signature string
 		Payload          []byte
@@ -188,40 +182,20 @@ func (r *Router) Route(in hookbot.Message, publish func(hookbot.Message) bool) {
 		return
 	}
 
-	repo := event.Repository.FullName
-	branch := event.Branch()
-
-	who := "<unknown>"
-	if event.Pusher != nil {
-		who = event.Pusher.Name
-	}
-
-	msgBytes, err := json.Marshal(map[string]string{
-		"Type":   event.Type,
-		"Repo":   repo,
-		"Branch": branch,
-		"SHA":    event.After,
-		"Who":    who,
-	})
-	if err != nil {
-		log.Printf("Failed to marshal Update: %v", err)
+	topic, summary, ok := event.Route()
+	if !ok {
+		log.Printf("Unhandled event type: %v (action %q)", event.Type, event.Action)
 		return
 	}
 
-	switch event.Type {
-	case "push":
-		topicFmt := "github.com/repo/%s/branch/%s"
-
-		// May fail
-		_ = publish(hookbot.Message{
-			Topic: fmt.Sprintf(topicFmt, repo, branch),
-			Body:  msgBytes,
-		})
-	default:
-		log.Printf("Unhandled event type: %v", event.Type)
+	msgBytes, err := json.Marshal(summary)
+	if err != nil {
+		log.Printf("Failed to marshal Summary: %v", err)
 		return
 	}
 
+	// May fail
+	_ = publish(hookbot.Message{Topic: topic, Body: msgBytes})
 }
 
 func init() {
@@ -0,0 +1,133 @@
+package github
+
+import (
+	"testing"
+
+	"github.com/sensiblecodeio/hookbot/pkg/hookbot"
+	"github.com/sensiblecodeio/hookbot/pkg/router/routertest"
+)
+
+const secret = "github_secret"
+
+// Route an event through Router, returning what it published. It is signed
+// as GitHub would.
+func route(t *testing.T, event, payload string) []hookbot.Message {
+	return routertest.Route(t, &Router{Secret: secret}, routertest.Metadata{
+		Signature:    "sha1=" + Sha1HMAC(secret, []byte(payload)),
+		Signature256: "sha256=" + Sha256HMAC(secret, []byte(payload)),
+		Event:        event,
+		Payload:      []byte(payload),
+	})
+}
+
+func TestRouteEvents(t *testing.T) {
+	const repo = `"repository": {"full_name": "sensiblecodeio/hookbot"}, "sender": {"login": "octocat"}`
+
+	for _, tc := range []struct {
+		event, payload string
+		topic, summary string
+	}{
+		{
+			"push",
+			`{"ref": "refs/heads/master", "after": "abc", "pusher": {"name": "pwaller"}, ` + repo + `}`,
+			"github.com/repo/sensiblecodeio/hookbot/branch/master",
+			`{"Type":"push","Repo":"sensiblecodeio/hookbot","Branch":"master","SHA":"abc","Who":"pwaller"}`,
+		},
+		{
+			"push",
+			`{"ref": "refs/tags/v1.2.3", "after": "abc", "pusher": {"name": "pwaller"}, ` + repo + `}`,
+			"github.com/repo/sensiblecodeio/hookbot/tag/v1.2.3",
+			`{"Type":"push","Repo":"sensiblecodeio/hookbot","Branch":"","SHA":"abc","Who":"pwaller","Tag":"v1.2.3"}`,
+		},
+		{
+			"push",
+			`{"ref": "refs/tags/v1.2.3", "after": "0000000000000000000000000000000000000000", "pusher": {"name": "pwaller"}, ` + repo + `}`,
+			"github.com/repo/sensiblecodeio/hookbot/tag/v1.2.3",
+			`{"Type":"push","Repo":"sensiblecodeio/hookbot","Branch":"","SHA":"0000000000000000000000000000000000000000","Who":"pwaller","Tag":"v1.2.3","Deleted":true}`,
+		},
+		{
+			"pull_request",
+			`{"action": "closed", "pull_request": {"number": 7, "merged": true, "html_url": "https://github.com/x", "head": {"ref": "feature", "sha": "def"}}, ` + repo + `}`,
+			"github.com/repo/sensiblecodeio/hookbot/pull/7",
+			`{"Type":"pull_request","Repo":"sensiblecodeio/hookbot","Branch":"feature","SHA":"def","Who":"octocat","Action":"closed","Number":7,"Merged":true,"URL":"https://github.com/x"}`,
+		},
+		{
+			"create",
+			`{"ref": "v1.0", "ref_type": "tag", ` + repo + `}`,
+			"github.com/repo/sensiblecodeio/hookbot/create/tag/v1.0",
+			`{"Type":"create","Repo":"sensiblecodeio/hookbot","Branch":"","SHA":"","Who":"octocat","Tag":"v1.0"}`,
+		},
+		{
+			"delete",
+			`{"ref": "feature", "ref_type": "branch", ` + repo + `}`,
+			"github.com/repo/sensiblecodeio/hookbot/delete/branch/feature",
+			`{"Type":"delete","Repo":"sensiblecodeio/hookbot","Branch":"feature","SHA":"","Who":"octocat","Deleted":true}`,
+		},
+		{
+			"release",
+			`{"action": "published", "release": {"tag_name": "v1.0", "html_url": "https://github.com/r"}, ` + repo + `}`,
+			"github.com/repo/sensiblecodeio/hookbot/release/v1.0",
+			`{"Type":"release","Repo":"sensiblecodeio/hookbot","Branch":"","SHA":"","Who":"octocat","Action":"published","Tag":"v1.0","URL":"https://github.com/r"}`,
+		},
+		{
+			"workflow_run",
+			`{"action": "completed", "workflow_run": {"name": "Build and test", "head_branch": "master", "head_sha": "abc", "status": "completed", "conclusion": "success"}, ` + repo + `}`,
+			"github.com/repo/sensiblecodeio/hookbot/workflow/Build%20and%20test",
+			`{"Type":"workflow_run","Repo":"sensiblecodeio/hookbot","Branch":"master","SHA":"abc","Who":"octocat","Action":"completed","Workflow":"Build and test","Status":"completed","Conclusion":"success"}`,
+		},
+		{
+			"check_suite",
+			`{"action": "completed", "check_suite": {"head_branch": "master", "head_sha": "abc", "status": "completed", "conclusion": "failure", "app": {"slug": "travis-ci"}}, ` + repo + `}`,
+			"github.com/repo/sensiblecodeio/hookbot/check_suite/travis-ci",
+			`{"Type":"check_suite","Repo":"sensiblecodeio/hookbot","Branch":"master","SHA":"abc","Who":"octocat","Action":"completed","App":"travis-ci","Status":"completed","Conclusion":"failure"}`,
+		},
+	} {
+		published := route(t, tc.event, tc.payload)
+		if len(published) != 1 {
+			t.Errorf("%v: published %d messages, expected 1", tc.event, len(published))
+			continue
+		}
+		if published[0].Topic != tc.topic {
+			t.Errorf("%v: topic %q, expected %q", tc.event, published[0].Topic, tc.topic)
+		}
+		if string(published[0].Body) != tc.summary {
+			t.Errorf("%v: summary %s, expected %s", tc.event, published[0].Body, tc.summary)
+		}
+	}
+}
+
+func TestRouteIgnoresOtherEvents(t *testing.T) {
+	const repo = `"repository": {"full_name": "sensiblecodeio/hookbot"}`
+
+	for _, tc := range []struct{ event, payload string }{
+		{"issues", `{"action": "opened", ` + repo + `}`},
+		{"pull_request", `{"action": "labeled", "pull_request": {"number": 7}, ` + repo + `}`},
+	} {
+		if published := route(t, tc.event, tc.payload); len(published) != 0 {
+			t.Errorf("%v: published %v", tc.event, published)
+		}
+	}
+}
+
+func TestRouteRejectsBadSignature(t *testing.T) {
+	payload := []byte(`{"ref": "refs/heads/master", "after": "abc", "repository": {"full_name": "sensiblecodeio/hookbot"}}`)
+
+	for _, tc := range []struct {
+		router   *Router
+		metadata routertest.Metadata
+	}{
+		{&Router{Secret: secret}, routertest.Metadata{}},
+		{&Router{Secret: secret}, routertest.Metadata{
+			Signature256: "sha256=" + Sha256HMAC("wrong", payload),
+		}},
+		{&Router{Secret: secret, RequireSHA256: true}, routertest.Metadata{
+			Signature: "sha1=" + Sha1HMAC(secret, payload),
+		}},
+	} {
+		tc.metadata.Event = "push"
+		tc.metadata.Payload = payload
+		if published := routertest.Route(t, tc.router, tc.metadata); len(published) != 0 {
+			t.Errorf("%+v: published %v", tc.metadata, published)
+		}
+	}
+}
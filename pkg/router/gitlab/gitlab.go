@@ -0,0 +1,212 @@
+// Package gitlab routes GitLab webhooks to per-project topics. The webhooks
+// are published to /unsafe/pub/<host>/... with ?extra-metadata=gitlab, which
+// checks their X-Gitlab-Token and signs them in its place.
+package gitlab
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/urfave/cli"
+
+	"github.com/sensiblecodeio/hookbot/pkg/hookbot"
+	"github.com/sensiblecodeio/hookbot/pkg/router"
+)
+
+type Summary = router.Summary
+
+// Event holds the parts of a GitLab webhook payload which Router uses. Which
+// fields are set depends on ObjectKind.
+type Event struct {
+	ObjectKind string `json:"object_kind"`
+
+	Project *Project `json:"project"`
+	User    *User    `json:"user"`
+
+	// Push and tag push events.
+	Ref          string `json:"ref"`
+	Before       string `json:"before"`
+	After        string `json:"after"`
+	UserUsername string `json:"user_username"`
+
+	ObjectAttributes *ObjectAttributes `json:"object_attributes"`
+}
+
+type Project struct {
+	PathWithNamespace string `json:"path_with_namespace"`
+	WebURL            string `json:"web_url"`
+}
+
+type User struct {
+	Username string `json:"username"`
+}
+
+// The merge request or pipeline which the event is about.
+type ObjectAttributes struct {
+	// Merge requests.
+	IID          int    `json:"iid"`
+	Action       string `json:"action"`
+	SourceBranch string `json:"source_branch"`
+	LastCommit   struct {
+		ID string `json:"id"`
+	} `json:"last_commit"`
+	URL string `json:"url"`
+
+	// Pipelines.
+	ID     int    `json:"id"`
+	Ref    string `json:"ref"`
+	Tag    bool   `json:"tag"`
+	SHA    string `json:"sha"`
+	Status string `json:"status"`
+}
+
+// Who caused the event.
+func (e *Event) Who() string {
+	switch {
+	case e.UserUsername != "":
+		return e.UserUsername
+	case e.User != nil:
+		return e.User.Username
+	}
+	return "<unknown>"
+}
+
+// Route returns the topic (below the host) and summary for an event, or
+// ok = false for object kinds other than those below. Merge requests are
+// numbered by their IID, the number shown in GitLab, rather than their global
+// ID, and pipelines are published under the ref they ran for.
+func (e *Event) Route() (topic string, summary Summary, ok bool) {
+	repo := e.Project.PathWithNamespace
+	base := "repo/" + repo
+
+	summary = Summary{
+		Type: e.ObjectKind,
+		Repo: repo,
+		Who:  e.Who(),
+	}
+
+	switch e.ObjectKind {
+	case "push":
+		summary.Branch = strings.TrimPrefix(e.Ref, "refs/heads/")
+		summary.SHA = e.After
+		summary.Deleted = router.IsDeletion(e.After)
+		return fmt.Sprintf("%s/branch/%s", base, summary.Branch), summary, true
+
+	case "tag_push":
+		summary.Tag = strings.TrimPrefix(e.Ref, "refs/tags/")
+		summary.SHA = e.After
+		summary.Deleted = router.IsDeletion(e.After)
+		return fmt.Sprintf("%s/tag/%s", base, summary.Tag), summary, true
+
+	case "merge_request":
+		mr := e.ObjectAttributes
+		if mr == nil {
+			return "", Summary{}, false
+		}
+		summary.Action = mr.Action
+		summary.Number = mr.IID
+		summary.Branch = mr.SourceBranch
+		summary.SHA = mr.LastCommit.ID
+		summary.Merged = mr.Action == "merge"
+		summary.URL = mr.URL
+		return fmt.Sprintf("%s/pull/%d", base, mr.IID), summary, true
+
+	case "pipeline":
+		pipeline := e.ObjectAttributes
+		if pipeline == nil {
+			return "", Summary{}, false
+		}
+		if pipeline.Tag {
+			summary.Tag = pipeline.Ref
+		} else {
+			summary.Branch = pipeline.Ref
+		}
+		summary.Number = pipeline.ID
+		summary.SHA = pipeline.SHA
+		summary.Status = pipeline.Status
+		return fmt.Sprintf("%s/pipeline/%s", base, pipeline.Ref), summary, true
+	}
+
+	return "", Summary{}, false
+}
+
+type Router struct {
+	Host string // Webhooks are consumed from /unsafe/<Host>/.
+	Key  string // The server's key, which ?extra-metadata=gitlab signs with.
+}
+
+func (r *Router) Name() string {
+	return "gitlab"
+}
+
+func (r *Router) Configure(c *cli.Context) error {
+	r.Host = c.String("gitlab-host")
+	r.Key = c.GlobalString("key")
+	if c.String("gitlab-secret") == "" {
+		// The server rejects every webhook without it.
+		return errors.New("--gitlab-secret is required")
+	}
+	return nil
+}
+
+func (r *Router) Topics() []string {
+	return []string{"/unsafe/" + r.Host + "/"}
+}
+
+func (r *Router) Route(in hookbot.Message, publish func(hookbot.Message) bool) {
+
+	log.Printf("route gitlab: %q", in.Topic)
+
+	var m struct {
+		Signature, Event string
+		Payload          []byte
+	}
+
+	err := json.Unmarshal(in.Body, &m)
+	if err != nil {
+		log.Printf("Failed to unmarshal gitlab message: %v", err)
+		return
+	}
+
+	// Only messages published with ?extra-metadata=gitlab and a valid
+	// X-Gitlab-Token are signed.
+	if !hookbot.SecureEqual(m.Signature, hookbot.GitlabSignature(r.Key, m.Payload)) {
+		log.Printf("Reject unsigned gitlab message")
+		return
+	}
+
+	var event Event
+	err = json.Unmarshal(m.Payload, &event)
+	if err != nil {
+		log.Printf("Route: error in json.Unmarshal: %v", err)
+		return
+	}
+
+	if event.Project == nil || event.Project.PathWithNamespace == "" {
+		log.Printf("Could not identify project for event %v", m.Event)
+		return
+	}
+
+	topic, summary, ok := event.Route()
+	if !ok {
+		log.Printf("Unhandled event type: %v", event.ObjectKind)
+		return
+	}
+
+	msgBytes, err := json.Marshal(summary)
+	if err != nil {
+		log.Printf("Failed to marshal Summary: %v", err)
+		return
+	}
+
+	// GitLab was answered when the webhook was published, so there's no
+	// one to tell if this fails.
+	_ = publish(hookbot.Message{Topic: r.Host + "/" + topic, Body: msgBytes})
+}
+
+func init() {
+	hookbot.RegisterRouter(&Router{Host: "gitlab.com"})
+}
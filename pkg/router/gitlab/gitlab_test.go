@@ -0,0 +1,73 @@
+package gitlab
+
+import (
+	"testing"
+
+	"github.com/sensiblecodeio/hookbot/pkg/hookbot"
+	"github.com/sensiblecodeio/hookbot/pkg/router/routertest"
+)
+
+const key = "hookbot_key"
+
+// Route an event through Router, returning what it published. GitLab's
+// event type is in the payload, so there's no Event.
+func route(t *testing.T, signature, payload string) []hookbot.Message {
+	return routertest.Route(t, &Router{Host: "gitlab.example.com", Key: key},
+		routertest.Metadata{Signature: signature, Payload: []byte(payload)})
+}
+
+func TestRouteEvents(t *testing.T) {
+	const project = `"project": {"path_with_namespace": "group/sub/app"}`
+
+	for _, tc := range []struct {
+		payload        string
+		topic, summary string
+	}{
+		{
+			`{"object_kind": "push", "ref": "refs/heads/main", "after": "abc", "user_username": "jo", ` + project + `}`,
+			"gitlab.example.com/repo/group/sub/app/branch/main",
+			`{"Type":"push","Repo":"group/sub/app","Branch":"main","SHA":"abc","Who":"jo"}`,
+		},
+		{
+			`{"object_kind": "tag_push", "ref": "refs/tags/v2", "after": "0000000000000000000000000000000000000000", "user_username": "jo", ` + project + `}`,
+			"gitlab.example.com/repo/group/sub/app/tag/v2",
+			`{"Type":"tag_push","Repo":"group/sub/app","Branch":"","SHA":"0000000000000000000000000000000000000000","Who":"jo","Tag":"v2","Deleted":true}`,
+		},
+		{
+			`{"object_kind": "merge_request", "user": {"username": "jo"}, "object_attributes": {"iid": 3, "action": "merge", "source_branch": "feature", "last_commit": {"id": "def"}, "url": "https://gitlab.example.com/mr"}, ` + project + `}`,
+			"gitlab.example.com/repo/group/sub/app/pull/3",
+			`{"Type":"merge_request","Repo":"group/sub/app","Branch":"feature","SHA":"def","Who":"jo","Action":"merge","Number":3,"Merged":true,"URL":"https://gitlab.example.com/mr"}`,
+		},
+		{
+			`{"object_kind": "pipeline", "user": {"username": "jo"}, "object_attributes": {"id": 42, "ref": "main", "sha": "abc", "status": "success"}, ` + project + `}`,
+			"gitlab.example.com/repo/group/sub/app/pipeline/main",
+			`{"Type":"pipeline","Repo":"group/sub/app","Branch":"main","SHA":"abc","Who":"jo","Number":42,"Status":"success"}`,
+		},
+	} {
+		published := route(t, hookbot.GitlabSignature(key, []byte(tc.payload)), tc.payload)
+		if len(published) != 1 {
+			t.Errorf("%v: published %d messages, expected 1", tc.topic, len(published))
+			continue
+		}
+		if published[0].Topic != tc.topic {
+			t.Errorf("Topic %q, expected %q", published[0].Topic, tc.topic)
+		}
+		if string(published[0].Body) != tc.summary {
+			t.Errorf("%v: summary %s, expected %s", tc.topic, published[0].Body, tc.summary)
+		}
+	}
+}
+
+func TestRouteRejectsBadSignature(t *testing.T) {
+	payload := `{"object_kind": "push", "ref": "refs/heads/main", "project": {"path_with_namespace": "app"}}`
+
+	for _, signature := range []string{
+		"",
+		hookbot.GitlabSignature("wrong", []byte(payload)),
+		hookbot.GitlabSignature(key, []byte("{}")),
+	} {
+		if published := route(t, signature, payload); len(published) != 0 {
+			t.Errorf("Signature %q: published %v", signature, published)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+// Package routertest provides utilities for testing the forge routers.
+package routertest
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/sensiblecodeio/hookbot/pkg/hookbot"
+)
+
+// Metadata holds the fields of an ?extra-metadata= message which the forge
+// routers read. Which of Signature and Event are used depends on the forge.
+type Metadata struct {
+	Signature    string `json:",omitempty"`
+	Signature256 string `json:",omitempty"` // GitHub only.
+	Event        string `json:",omitempty"`
+	Payload      []byte
+}
+
+// Route passes `m` to `r` as though it had been published under the first of
+// r's topics, returning the messages which r published in turn.
+func Route(t testing.TB, r hookbot.Router, m Metadata) []hookbot.Message {
+	t.Helper()
+
+	body, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var published []hookbot.Message
+	r.Route(hookbot.Message{Topic: r.Topics()[0] + "hook", Body: body},
+		func(m hookbot.Message) bool {
+			published = append(published, m)
+			return true
+		})
+	return published
+}
@@ -0,0 +1,347 @@
+// Package rules provides a router configured from a JSON file of rules, for
+// rebroadcasting webhooks without writing a router in Go.
+//
+// Each rule matches messages on a topic, optionally only those whose JSON
+// body has particular field values, and republishes them to a topic made from
+// a template. For example:
+//
+//	[
+//	  {
+//	    "topic": "/unsafe/hub.docker.com/",
+//	    "equals": {"push_data.tag": "latest"},
+//	    "matches": {"repository.repo_name": "^sensiblecodeio/"},
+//	    "publish": "docker/{{.repository.namespace}}/{{.repository.name}}"
+//	  }
+//	]
+//
+// Values substituted into the topic can't contain "/" or control characters,
+// so that a message can't choose a topic outside of the template's shape.
+package rules
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/urfave/cli"
+
+	"github.com/sensiblecodeio/hookbot/pkg/hookbot"
+)
+
+type Rule struct {
+	// Messages on this topic are considered. Ending it with "/" matches all
+	// topics below it.
+	Topic string `json:"topic"`
+
+	// If set, the body is taken to be this field holding the JSON document,
+	// such as "Payload" for ?extra-metadata=github or "Body" for
+	// ?extra-metadata=headers.
+	Unwrap string `json:"unwrap"`
+
+	// Fields of the body, as dot-separated paths, which must equal or match
+	// the regular expressions given. Array elements are selected by index.
+	Equals  map[string]string `json:"equals"`
+	Matches map[string]string `json:"matches"`
+
+	// A text/template for the topic to republish the message on, executed on
+	// the body. Strings containing "/" or control characters can't be
+	// substituted into it.
+	Publish string `json:"publish"`
+
+	matches map[string]*regexp.Regexp
+	publish *template.Template
+}
+
+// Prepare the rule's regular expressions and template.
+func (rule *Rule) compile() error {
+	if rule.Topic == "" {
+		return errors.New("missing topic")
+	}
+	if rule.Publish == "" {
+		return errors.New("missing publish")
+	}
+
+	rule.matches = map[string]*regexp.Regexp{}
+	for path, expr := range rule.Matches {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("matches %q: %v", path, err)
+		}
+		rule.matches[path] = re
+	}
+
+	var err error
+	rule.publish, err = template.New("publish").
+		Option("missingkey=error").Parse(rule.Publish)
+	if err != nil {
+		return fmt.Errorf("publish: %v", err)
+	}
+	return nil
+}
+
+// LoadRules reads and compiles a JSON array of rules from `path`.
+func LoadRules(path string) ([]*Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []*Rule
+	err = json.Unmarshal(data, &rules)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, rule := range rules {
+		err = rule.compile()
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+	}
+	return rules, nil
+}
+
+// Look up a dot-separated path in a decoded JSON document.
+func lookup(doc interface{}, path string) (interface{}, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			var ok bool
+			doc, ok = v[key]
+			if !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			doc = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// Decode a JSON document, keeping numbers as they were written, so that large
+// ones don't become floating point, e.g. 1.2345678e+07.
+func decode(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var doc interface{}
+	err := dec.Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("invalid JSON: data after the document")
+	}
+	return doc, nil
+}
+
+// The document which the rule's predicates and template apply to.
+func (rule *Rule) document(body []byte) (interface{}, error) {
+	doc, err := decode(body)
+	if err != nil || rule.Unwrap == "" {
+		return doc, err
+	}
+
+	inner, ok := lookup(doc, rule.Unwrap)
+	if !ok {
+		return nil, fmt.Errorf("no %q field to unwrap", rule.Unwrap)
+	}
+	s, ok := inner.(string)
+	if !ok {
+		return inner, nil
+	}
+
+	// Either JSON in a string, or JSON encoded as bytes, which is base64.
+	doc, err = decode([]byte(s))
+	if err == nil {
+		return doc, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("%q field is not JSON", rule.Unwrap)
+	}
+	return decode(decoded)
+}
+
+// Stands in for strings which can't be substituted into a topic. Being a
+// control character, it can't appear in a valid topic otherwise.
+const unsafeValue = "\x00"
+
+// A copy of `doc` with strings containing "/" or control characters replaced
+// by unsafeValue.
+func substitutable(doc interface{}) interface{} {
+	switch v := doc.(type) {
+	case string:
+		if strings.ContainsRune(v, '/') || strings.IndexFunc(v, unicode.IsControl) != -1 {
+			return unsafeValue
+		}
+		return v
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			out[key] = substitutable(value)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, value := range v {
+			out[i] = substitutable(value)
+		}
+		return out
+	}
+	return doc
+}
+
+// Apply the rule to a message, returning the topic to republish it on, or
+// ok = false if the rule doesn't match.
+func (rule *Rule) Apply(m hookbot.Message) (topic string, ok bool, err error) {
+	if !hookbot.TopicAllowed([]string{rule.Topic}, m.Topic) {
+		return "", false, nil
+	}
+
+	doc, err := rule.document(m.Body)
+	if err != nil {
+		return "", false, err
+	}
+
+	for path, want := range rule.Equals {
+		value, ok := lookup(doc, path)
+		if !ok || fmt.Sprint(value) != want {
+			return "", false, nil
+		}
+	}
+	for path, re := range rule.matches {
+		value, ok := lookup(doc, path)
+		if !ok || !re.MatchString(fmt.Sprint(value)) {
+			return "", false, nil
+		}
+	}
+
+	var buf bytes.Buffer
+	err = rule.publish.Execute(&buf, substitutable(doc))
+	if err != nil {
+		return "", false, err
+	}
+	topic = buf.String()
+	switch {
+	case topic == "":
+		return "", false, errors.New("empty topic")
+	case strings.Contains(topic, unsafeValue):
+		return "", false, errors.New(
+			`a value in the topic contains "/" or a control character`)
+	case !hookbot.ValidTopic(topic):
+		return "", false, fmt.Errorf("invalid topic %q", topic)
+	}
+	return topic, true, nil
+}
+
+type Router struct {
+	Rules []*Rule
+
+	topics []string // See Topics.
+}
+
+// NewRouter returns a Router which applies `rules`.
+func NewRouter(rules []*Rule) *Router {
+	return &Router{Rules: rules, topics: coveringTopics(rules)}
+}
+
+func (r *Router) Name() string {
+	return "rules"
+}
+
+func (r *Router) Configure(c *cli.Context) error {
+	path := c.String("rules-file")
+	if path == "" {
+		return errors.New("--rules-file is required")
+	}
+
+	rules, err := LoadRules(path)
+	if err != nil {
+		return err
+	}
+	*r = *NewRouter(rules)
+	return nil
+}
+
+// The rules' topics, less those covered by another, so that no message is
+// routed twice.
+func (r *Router) Topics() []string {
+	return r.topics
+}
+
+func coveringTopics(rules []*Rule) []string {
+	all := []string{}
+	for _, rule := range rules {
+		all = append(all, rule.Topic)
+	}
+
+	topics := []string{}
+	for i, topic := range all {
+		covered := false
+		for j, other := range all {
+			if i == j {
+				continue
+			}
+			if (other == topic && j < i) ||
+				(other != topic && hookbot.TopicAllowed([]string{other}, topic)) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
+
+func (r *Router) Route(in hookbot.Message, publish func(hookbot.Message) bool) {
+
+	log.Printf("route rules: %q", in.Topic)
+
+	for i, rule := range r.Rules {
+		topic, ok, err := rule.Apply(in)
+		if err != nil {
+			log.Printf("Rule %d on %q: %v", i, in.Topic, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		// Don't feed messages back into the router.
+		if hookbot.TopicAllowed(r.topics, topic) {
+			log.Printf("Rule %d: not republishing %q to %q, which rules consume",
+				i, in.Topic, topic)
+			continue
+		}
+
+		// Other rules still apply if this fails.
+		_ = publish(hookbot.Message{
+			Topic:       topic,
+			Body:        in.Body,
+			ContentType: in.ContentType,
+		})
+	}
+}
+
+func init() {
+	hookbot.RegisterRouter(&Router{})
+}
@@ -0,0 +1,161 @@
+package rules
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sensiblecodeio/hookbot/pkg/hookbot"
+)
+
+const testRules = `[
+	{
+		"topic": "/unsafe/hub.docker.com/",
+		"equals": {"push_data.tag": "latest"},
+		"matches": {"repository.repo_name": "^sensiblecodeio/"},
+		"publish": "docker/{{.repository.namespace}}/{{.repository.name}}/{{.push_data.tag}}"
+	},
+	{
+		"topic": "/unsafe/sentry",
+		"unwrap": "Body",
+		"equals": {"data.issues.0.level": "error"},
+		"publish": "sentry/{{.project}}"
+	},
+	{
+		"topic": "/unsafe/hub.docker.com/mirror",
+		"publish": "docker/mirror"
+	}
+]`
+
+func loadTestRules(t *testing.T) *Router {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(path, []byte(testRules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := LoadRules(path)
+	if err != nil {
+		t.Fatalf("LoadRules: %v", err)
+	}
+	return NewRouter(rules)
+}
+
+// Route a message, returning the topics it was republished to.
+func route(r *Router, topic, body string) []string {
+	published := []string{}
+	r.Route(hookbot.Message{Topic: topic, Body: []byte(body)},
+		func(m hookbot.Message) bool {
+			if string(m.Body) != body {
+				panic("body changed")
+			}
+			published = append(published, m.Topic)
+			return true
+		})
+	return published
+}
+
+func TestRules(t *testing.T) {
+	r := loadTestRules(t)
+
+	docker := func(repo, tag string) string {
+		namespace, name, _ := strings.Cut(repo, "/")
+		return `{"repository": {"repo_name": "` + repo + `", "namespace": "` + namespace +
+			`", "name": "` + name + `"}, "push_data": {"tag": "` + tag + `"}}`
+	}
+	sentry := func(level string) string {
+		inner := `{"project": "api", "data": {"issues": [{"level": "` + level + `"}]}}`
+		wrapped, _ := json.Marshal(map[string]string{"Body": inner})
+		return string(wrapped)
+	}
+
+	for _, tc := range []struct {
+		topic, body string
+		expected    []string
+	}{
+		{"/unsafe/hub.docker.com/hook", docker("sensiblecodeio/app", "latest"),
+			[]string{"docker/sensiblecodeio/app/latest"}},
+		{"/unsafe/hub.docker.com/hook", docker("sensiblecodeio/app", "v1"), []string{}},
+		{"/unsafe/hub.docker.com/hook", docker("other/app", "latest"), []string{}},
+		{"/unsafe/hub.docker.com/mirror", docker("sensiblecodeio/app", "latest"),
+			[]string{"docker/sensiblecodeio/app/latest", "docker/mirror"}},
+		{"/unsafe/sentry", sentry("error"), []string{"sentry/api"}},
+		{"/unsafe/sentry", sentry("warning"), []string{}},
+		{"/unsafe/sentry/below", sentry("error"), []string{}},
+		{"/unsafe/hub.docker.com/hook", "not json", []string{}},
+	} {
+		got := route(r, tc.topic, tc.body)
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%v %s: published to %v, expected %v",
+				tc.topic, tc.body, got, tc.expected)
+		}
+	}
+}
+
+// Topics covered by another rule's aren't listened to twice.
+func TestRulesTopics(t *testing.T) {
+	r := loadTestRules(t)
+
+	expected := []string{"/unsafe/hub.docker.com/", "/unsafe/sentry"}
+	if got := r.Topics(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Topics() = %v, expected %v", got, expected)
+	}
+}
+
+// A rule which would republish into a topic the rules consume is skipped.
+func TestRulesNoLoop(t *testing.T) {
+	rule := &Rule{Topic: "loop/", Publish: "loop/again"}
+	if err := rule.compile(); err != nil {
+		t.Fatal(err)
+	}
+	r := NewRouter([]*Rule{rule})
+
+	if got := route(r, "loop/start", "{}"); len(got) != 0 {
+		t.Errorf("Published to %v", got)
+	}
+}
+
+// Numbers are substituted as written, and strings which would change the
+// shape of the topic are refused.
+func TestRulesSubstitution(t *testing.T) {
+	rule := &Rule{Topic: "in", Publish: "out/{{.id}}/{{.name}}"}
+	if err := rule.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		body, expected string
+	}{
+		{`{"id": 12345678, "name": "app"}`, "out/12345678/app"},
+		{`{"id": 1.50, "name": "app"}`, "out/1.50/app"},
+		{`{"id": 1, "name": "../other"}`, ""},
+		{`{"id": 1, "name": "a\nb"}`, ""},
+		{`{"id": 1, "name": "app"} {}`, ""},
+	} {
+		topic, ok, err := rule.Apply(hookbot.Message{Topic: "in", Body: []byte(tc.body)})
+		if tc.expected == "" {
+			if ok || err == nil {
+				t.Errorf("%s: published to %q", tc.body, topic)
+			}
+			continue
+		}
+		if !ok || err != nil || topic != tc.expected {
+			t.Errorf("%s: Apply() = %q, %v, %v, expected %q",
+				tc.body, topic, ok, err, tc.expected)
+		}
+	}
+}
+
+func TestRulesInvalid(t *testing.T) {
+	for _, rule := range []*Rule{
+		{Publish: "out"},
+		{Topic: "in"},
+		{Topic: "in", Publish: "{{"},
+		{Topic: "in", Publish: "out", Matches: map[string]string{"a": "("}},
+	} {
+		if err := rule.compile(); err == nil {
+			t.Errorf("%+v compiled", rule)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+// Package router holds what the webhook routers in its subpackages share.
+package router
+
+import "regexp"
+
+// Summary is the compact message which routers publish for each event. The
+// first five fields are always present; the rest only where they apply.
+type Summary struct {
+	Type   string
+	Repo   string
+	Branch string
+	SHA    string
+	Who    string
+
+	Action     string `json:",omitempty"`
+	Number     int    `json:",omitempty"`
+	Tag        string `json:",omitempty"`
+	Merged     bool   `json:",omitempty"`
+	Deleted    bool   `json:",omitempty"`
+	Workflow   string `json:",omitempty"`
+	App        string `json:",omitempty"`
+	Status     string `json:",omitempty"`
+	Conclusion string `json:",omitempty"`
+	URL        string `json:",omitempty"`
+}
+
+// A push whose new commit is all zeros deletes the ref.
+var deletedSHA = regexp.MustCompile("^0+$")
+
+// IsDeletion returns true if `after`, the new commit of a push, means that the
+// ref was deleted.
+func IsDeletion(after string) bool {
+	return deletedSHA.MatchString(after)
+}